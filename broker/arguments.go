@@ -0,0 +1,168 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	ClassicQueue = "classic"
+	QuorumQueue  = "quorum"
+
+	OverflowDropHead         = "drop-head"
+	OverflowRejectPublish    = "reject-publish"
+	OverflowRejectPublishDlx = "reject-publish-dlx"
+)
+
+func (p *RabbitMqQueueProperties) Validate() error {
+	switch p.Type {
+	case "", ClassicQueue:
+	case QuorumQueue:
+		if !p.Durable {
+			return fmt.Errorf("quorum queue must be durable")
+		}
+		if p.AutoDelete {
+			return fmt.Errorf("quorum queue can not be auto deleted")
+		}
+		if p.Exclusive {
+			return fmt.Errorf("quorum queue can not be exclusive")
+		}
+		if p.Overflow == OverflowRejectPublishDlx {
+			return fmt.Errorf("overflow %s not supported by quorum queues", p.Overflow)
+		}
+	default:
+		return fmt.Errorf("unknown queue type %s", p.Type)
+	}
+	switch p.Overflow {
+	case "", OverflowDropHead, OverflowRejectPublish, OverflowRejectPublishDlx:
+	default:
+		return fmt.Errorf("unknown overflow behaviour %s", p.Overflow)
+	}
+	if p.MessageTtl < 0 {
+		return fmt.Errorf("negative message ttl %s", p.MessageTtl)
+	}
+	if p.MessageTtl > 0 && p.MessageTtl < time.Millisecond {
+		return fmt.Errorf("message ttl %s lower than 1ms", p.MessageTtl)
+	}
+	if p.Expires < 0 {
+		return fmt.Errorf("negative queue expires %s", p.Expires)
+	}
+	if p.Expires > 0 && p.Expires < time.Millisecond {
+		return fmt.Errorf("queue expires %s lower than 1ms", p.Expires)
+	}
+	if p.MaxLength < 0 {
+		return fmt.Errorf("negative max length %d", p.MaxLength)
+	}
+	if p.MaxLengthBytes < 0 {
+		return fmt.Errorf("negative max length bytes %d", p.MaxLengthBytes)
+	}
+	if p.DeadLetterRoutingKey != "" && p.DeadLetterExchange == "" {
+		return fmt.Errorf("dead letter routing key set without dead letter exchange")
+	}
+	return nil
+}
+
+func (p *RabbitMqQueueProperties) Arguments() (amqp.Table, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	args := amqp.Table{}
+	for k, v := range p.Args {
+		value, err := argumentValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("argument %s, %s", k, err)
+		}
+		args[k] = value
+	}
+	typed := amqp.Table{}
+	if p.Type != "" {
+		typed["x-queue-type"] = p.Type
+	}
+	if p.MessageTtl > 0 {
+		typed["x-message-ttl"] = int64(p.MessageTtl / time.Millisecond)
+	}
+	if p.Expires > 0 {
+		typed["x-expires"] = int64(p.Expires / time.Millisecond)
+	}
+	if p.MaxLength > 0 {
+		typed["x-max-length"] = int64(p.MaxLength)
+	}
+	if p.MaxLengthBytes > 0 {
+		typed["x-max-length-bytes"] = int64(p.MaxLengthBytes)
+	}
+	if p.Overflow != "" {
+		typed["x-overflow"] = p.Overflow
+	}
+	if p.DeadLetterExchange != "" {
+		typed["x-dead-letter-exchange"] = p.DeadLetterExchange
+	}
+	if p.DeadLetterRoutingKey != "" {
+		typed["x-dead-letter-routing-key"] = p.DeadLetterRoutingKey
+	}
+	for k, v := range typed {
+		if existing, ok := args[k]; ok && fmt.Sprint(existing) != fmt.Sprint(v) {
+			return nil, fmt.Errorf("argument %s set to %v in args and to %v by queue properties", k, existing, v)
+		}
+		args[k] = v
+	}
+	if len(args) == 0 {
+		return nil, nil
+	}
+	if err := args.Validate(); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+func argumentValue(v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case int:
+		return int64(value), nil
+	case int8:
+		return int64(value), nil
+	case uint16:
+		return int64(value), nil
+	case uint32:
+		return int64(value), nil
+	case uint64:
+		return int64(value), nil
+	case uint:
+		return int64(value), nil
+	case float32:
+		return float64(value), nil
+	case map[string]interface{}:
+		table := amqp.Table{}
+		for k, e := range value {
+			tv, err := argumentValue(e)
+			if err != nil {
+				return nil, err
+			}
+			table[k] = tv
+		}
+		return table, nil
+	case map[interface{}]interface{}:
+		table := amqp.Table{}
+		for k, e := range value {
+			tv, err := argumentValue(e)
+			if err != nil {
+				return nil, err
+			}
+			table[fmt.Sprint(k)] = tv
+		}
+		return table, nil
+	case []interface{}:
+		list := make([]interface{}, len(value))
+		for i, e := range value {
+			lv, err := argumentValue(e)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = lv
+		}
+		return list, nil
+	default:
+		return v, nil
+	}
+}
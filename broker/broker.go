@@ -1,133 +1,163 @@
 package broker
 
 import (
-	"github.com/streadway/amqp"
-	"sync"
-	"strings"
-	"fmt"
+	"context"
+	"time"
+
+	"github.com/ivanmtzp/go-microservice/log"
 )
 
-type RabbitMqQueueProperties struct {
-	Name string
-	Durable bool
-	AutoDelete bool
-	Exclusive bool
-	NoWait bool
-}
+const (
+	DirectExchange = "direct"
+	TopicExchange  = "topic"
+	FanoutExchange = "fanout"
+)
 
-type RabbitMqConsumerProperties struct {
-	Name string
-	QueueName string
-	AutoAck bool
-	Exclusive bool
-	NoLocal bool
-	NoWait bool
+type Broker interface {
+	Address() string
+	DeclareExchange(p *ExchangeProperties) error
+	DeclareQueue(id string, p *QueueProperties) (string, error)
+	BindQueue(queueName, key, exchange string) error
+	Publish(exchange, key string, m *Message) error
+	Consume(id string, handler HandlerFunc, p *ConsumerProperties) error
+	Run()
+	Close()
 }
 
-type ConsumerHandlerFunc func(channel *amqp.Channel, delivery *amqp.Delivery)
+type ExchangeProperties struct {
+	Name       string
+	Kind       string
+	Durable    bool
+	AutoDelete bool
+}
 
-type ConsumerChannel struct {
-	channel <-chan amqp.Delivery
-	handler ConsumerHandlerFunc
+// QueueProperties are the queue settings shared by the brokers, each one maps them to its own
+// declaration and reads the settings only it understands from Args
+type QueueProperties struct {
+	Name                 string
+	Durable              bool
+	AutoDelete           bool
+	Exclusive            bool
+	MessageTtl           time.Duration
+	MaxLength            int
+	Overflow             string
+	DeadLetterExchange   string
+	DeadLetterRoutingKey string
+	Args                 map[string]interface{}
 }
 
-type RabbitMqBroker struct {
-	address string
-	connection *amqp.Connection
-	channel *amqp.Channel
-	queues map[string]*amqp.Queue
-	consumers map[string]*ConsumerChannel
+// ConsumerProperties are the consumer settings shared by the brokers. QueueName is a queue,
+// or nameFromQueue(id), for RabbitMQ and a topic for Kafka, where Group is the consumer group.
+type ConsumerProperties struct {
+	Name          string
+	QueueName     string
+	Group         string
+	AutoAck       bool
+	Exclusive     bool
+	PrefetchCount int
 }
 
+type Message struct {
+	MessageId     string
+	CorrelationId string
+	ReplyTo       string
+	ContentType   string
+	Headers       map[string]interface{}
+	Timestamp     time.Time
+	Body          []byte
+}
 
-func NewRabbitMqBroker(address string, prefetchCount, prefetchSize int) (*RabbitMqBroker, error) {
-	connection, err := amqp.Dial(address)
-	if err != nil {
-		return nil, err
-	}
-	channel, err := connection.Channel()
-	if err != nil {
-		return nil, err
+// SetContextHeaders propagates the request and trace ids of ctx to the message, so the consumers
+// log them. The trace id goes as a traceparent, or as x-trace-id when it is not a W3C one.
+func (m *Message) SetContextHeaders(ctx context.Context) {
+	fields := log.ContextFields(ctx)
+	set := func(name, value string) {
+		if value == "" {
+			return
+		}
+		if m.Headers == nil {
+			m.Headers = make(map[string]interface{})
+		}
+		m.Headers[name] = value
 	}
-	err = channel.Qos(prefetchCount, prefetchSize, false)
-	if err != nil {
-		return nil, err
+	requestId, _ := fields[log.RequestIdField].(string)
+	set(log.RequestIdHeader, requestId)
+	if traceparent := log.Traceparent(ctx); traceparent != "" {
+		set(log.TraceparentHeader, traceparent)
+	} else {
+		traceId, _ := fields[log.TraceIdField].(string)
+		set(log.TraceIdHeader, traceId)
 	}
-	return &RabbitMqBroker{
-		address: address,
-		connection: connection,
-		channel:channel,
-		queues: make(map[string]*amqp.Queue),
-		consumers: make(map[string]*ConsumerChannel)}, nil
 }
 
-func (b *RabbitMqBroker) Address() string {
-	return b.address
+type Acknowledger interface {
+	Ack(tag uint64) error
+	Nack(tag uint64, requeue bool) error
 }
 
-func (b *RabbitMqBroker) Channel() *amqp.Channel {
-	return b.channel
-}
+type Delivery struct {
+	Message
+	ConsumerId  string
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
 
-func (b *RabbitMqBroker) Queue(id string) (*amqp.Queue, bool) {
-	q, ok := b.queues[id]
-	return q, ok
+	tag          uint64
+	acknowledger Acknowledger
+	ctx          context.Context
 }
 
-func (b *RabbitMqBroker) WithQueue(id string, p *RabbitMqQueueProperties) (*amqp.Queue, error) {
-	queue, err := b.channel.QueueDeclare( p.Name, p.Durable, p.AutoDelete, p.Exclusive, p.NoWait, nil)
-	if err != nil {
-		return nil, err
+type HandlerFunc func(d *Delivery)
+
+func (d *Delivery) Ack() error {
+	if d.acknowledger == nil {
+		return nil
 	}
-	b.queues[id] = &queue
-	return &queue, nil
+	return d.acknowledger.Ack(d.tag)
 }
 
-func (b *RabbitMqBroker) WithConsumerChannel(id string, handler ConsumerHandlerFunc, p *RabbitMqConsumerProperties) (<-chan amqp.Delivery, error) {
-	queueName := p.QueueName
-	if strings.HasPrefix(queueName, "nameFromQueue(") && strings.HasSuffix(queueName, ")") {
-		queueId := strings.TrimLeft(strings.TrimRight(queueName, ")"), "nameFromQueue(")
-		q, ok := b.queues[queueId]
-		if !ok {
-			return nil, fmt.Errorf("unable to find queue name for queue id %s", queueId)
-		}
-		queueName = q.Name
+func (d *Delivery) Nack(requeue bool) error {
+	if d.acknowledger == nil {
+		return nil
 	}
-	consumerChannel, err := b.channel.Consume(queueName, p.Name, p.AutoAck, p.Exclusive, p.NoLocal, p.NoWait, nil)
-	if err != nil {
-		return nil, err
-	}
-	b.consumers[id] = &ConsumerChannel{
-		channel: consumerChannel,
-		handler: handler,
-	}
-	return consumerChannel, nil
+	return d.acknowledger.Nack(d.tag, requeue)
 }
 
-func (b *RabbitMqBroker) Close() {
-	if b.channel != nil {
-		b.channel.Close()
-	}
-	if b.connection != nil {
-		b.connection.Close()
+// Context carries the log correlation fields of the delivery, use it with log.FromContext
+func (d *Delivery) Context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
 	}
+	return d.ctx
 }
 
-func (b *RabbitMqBroker) Run() {
-	var wg sync.WaitGroup
-	wg.Add(len(b.consumers))
-	for _, v := range b.consumers {
-		go func() {
-			defer wg.Done()
-			for d := range v.channel {
-				v.handler(b.channel, &d)
-			}
-		}()
+func (d *Delivery) header(name string) string {
+	if value, ok := d.Headers[name]; ok {
+		if s, ok := value.(string); ok {
+			return s
+		}
 	}
-	wg.Wait()
+	return ""
 }
 
-
-
-
-
+// withLogContext attaches the consumer, request and trace ids to the delivery context, the
+// request id is taken from the x-request-id header, the correlation id or the message id
+func withLogContext(d *Delivery) *Delivery {
+	requestId := d.header(log.RequestIdHeader)
+	if requestId == "" {
+		requestId = d.CorrelationId
+	}
+	if requestId == "" {
+		requestId = d.MessageId
+	}
+	traceId := log.TraceId(d.header(log.TraceparentHeader))
+	if traceId == "" {
+		traceId = d.header(log.TraceIdHeader)
+	}
+	d.ctx = log.NewContext(context.Background(), log.Fields{
+		log.ConsumerField:  d.ConsumerId,
+		log.RequestIdField: requestId,
+		log.TraceIdField:   traceId,
+	})
+	return d
+}
@@ -0,0 +1,197 @@
+package broker
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/ivanmtzp/go-microservice/log"
+	"github.com/ivanmtzp/go-microservice/monitoring"
+)
+
+const (
+	DeduplicationStoreMemory   = "memory"
+	DeduplicationStoreDatabase = "database"
+)
+
+type DeduplicationProperties struct {
+	Store  string
+	Header string
+	Ttl    time.Duration
+	Size   int
+}
+
+type DeduplicationStore interface {
+	Contains(key string) (bool, error)
+	Add(key string) error
+}
+
+// deduplicationAcknowledger records the nacks of the handler, a nacked message is handled again
+// when redelivered
+type deduplicationAcknowledger struct {
+	acknowledger Acknowledger
+	nacked       bool
+}
+
+func (a *deduplicationAcknowledger) Ack(tag uint64) error {
+	return a.acknowledger.Ack(tag)
+}
+
+func (a *deduplicationAcknowledger) Nack(tag uint64, requeue bool) error {
+	a.nacked = true
+	return a.acknowledger.Nack(tag, requeue)
+}
+
+func deduplicationKey(d *Delivery, header string) string {
+	if header == "" {
+		return d.MessageId
+	}
+	if v, ok := d.Headers[header]; ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// Deduplicate skips the messages already handled by the consumer, acking them. A message is
+// recorded once the handler returns without nacking it, auto ack deliveries are always recorded.
+func Deduplicate(store DeduplicationStore, header string, handler HandlerFunc) HandlerFunc {
+	return func(d *Delivery) {
+		deduplicate(store, header, d, func() bool {
+			if d.acknowledger == nil {
+				handler(d)
+				return false
+			}
+			a := &deduplicationAcknowledger{acknowledger: d.acknowledger}
+			d.acknowledger = a
+			handler(d)
+			return a.nacked
+		})
+	}
+}
+
+// rabbitMqDeduplicationAcknowledger records the nacks and rejects of a channel handler
+type rabbitMqDeduplicationAcknowledger struct {
+	amqp.Acknowledger
+	nacked bool
+}
+
+func (a *rabbitMqDeduplicationAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.nacked = true
+	return a.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (a *rabbitMqDeduplicationAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.nacked = true
+	return a.Acknowledger.Reject(tag, requeue)
+}
+
+// DeduplicateConsumer applies Deduplicate to the channel handler of the RabbitMQ consumer id,
+// using the header of p.Deduplication
+func DeduplicateConsumer(id string, p *RabbitMqConsumerProperties, store DeduplicationStore, handler ConsumerHandlerFunc) ConsumerHandlerFunc {
+	header := ""
+	if p.Deduplication != nil {
+		header = p.Deduplication.Header
+	}
+	return func(channel *amqp.Channel, d *amqp.Delivery) {
+		deduplicate(store, header, newRabbitMqDelivery(id, d, p.AutoAck), func() bool {
+			if p.AutoAck || d.Acknowledger == nil {
+				handler(channel, d)
+				return false
+			}
+			a := &rabbitMqDeduplicationAcknowledger{Acknowledger: d.Acknowledger}
+			d.Acknowledger = a
+			handler(channel, d)
+			return a.nacked
+		})
+	}
+}
+
+// deduplicate runs handle unless d is a duplicate, and records d when handle doesn't report a nack
+func deduplicate(store DeduplicationStore, header string, d *Delivery, handle func() (nacked bool)) {
+	id := deduplicationKey(d, header)
+	if id == "" {
+		handle()
+		return
+	}
+	key := fmt.Sprintf("%s:%s", d.ConsumerId, id)
+	seen, err := store.Contains(key)
+	if err != nil {
+		log.Warningf("deduplication lookup failed for consumer %s message %s: %s", d.ConsumerId, id, err)
+	}
+	if seen {
+		monitoring.IncCounter(fmt.Sprintf("broker.%s.duplicates", d.ConsumerId), 1)
+		log.Debugf("duplicate message %s skipped by consumer %s", id, d.ConsumerId)
+		if err := d.Ack(); err != nil {
+			log.Errorf("failed to ack duplicate message %s on consumer %s: %s", id, d.ConsumerId, err)
+		}
+		return
+	}
+	if handle() {
+		return
+	}
+	if err := store.Add(key); err != nil {
+		log.Warningf("deduplication store failed for consumer %s message %s: %s", d.ConsumerId, id, err)
+	}
+}
+
+type memoryDeduplicationEntry struct {
+	key     string
+	expires time.Time
+}
+
+type MemoryDeduplicationStore struct {
+	mutex   sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func NewMemoryDeduplicationStore(size int, ttl time.Duration) *MemoryDeduplicationStore {
+	if size <= 0 {
+		size = 10000
+	}
+	return &MemoryDeduplicationStore{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (s *MemoryDeduplicationStore) Contains(key string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return false, nil
+	}
+	entry := e.Value.(*memoryDeduplicationEntry)
+	if s.ttl > 0 && time.Now().After(entry.expires) {
+		s.order.Remove(e)
+		delete(s.entries, key)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *MemoryDeduplicationStore) Add(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	expires := time.Now().Add(s.ttl)
+	if e, ok := s.entries[key]; ok {
+		e.Value.(*memoryDeduplicationEntry).expires = expires
+		s.order.MoveToFront(e)
+		return nil
+	}
+	s.entries[key] = s.order.PushFront(&memoryDeduplicationEntry{key: key, expires: expires})
+	for s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryDeduplicationEntry).key)
+	}
+	return nil
+}
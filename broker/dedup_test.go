@@ -0,0 +1,120 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+type fakeAmqpAcknowledger struct {
+	calls []string
+}
+
+func (a *fakeAmqpAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.calls = append(a.calls, fmt.Sprintf("ack %d", tag))
+	return nil
+}
+
+func (a *fakeAmqpAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.calls = append(a.calls, fmt.Sprintf("nack %d", tag))
+	return nil
+}
+
+func (a *fakeAmqpAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.calls = append(a.calls, fmt.Sprintf("reject %d", tag))
+	return nil
+}
+
+func consumeDeduplicated(t *testing.T, b *InMemoryBroker, queueName string, p *ConsumerProperties, handler HandlerFunc) {
+	p.QueueName = queueName
+	store := NewMemoryDeduplicationStore(10, 0)
+	if err := b.Consume(queueName, Deduplicate(store, "", handler), p); err != nil {
+		t.Fatalf("consume %s failed: %s", queueName, err)
+	}
+	go b.Run()
+}
+
+func publish(t *testing.T, b *InMemoryBroker, queueName string, ids ...string) {
+	for _, id := range ids {
+		if err := b.Publish("", queueName, &Message{MessageId: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDeduplicateAutoAck(t *testing.T) {
+	b := newTestBroker(t)
+	queue := declareQueue(t, b, &QueueProperties{Name: "orders"})
+	deliveries := make(chan *Delivery, 10)
+	consumeDeduplicated(t, b, queue, &ConsumerProperties{AutoAck: true}, func(d *Delivery) {
+		deliveries <- d
+	})
+
+	publish(t, b, queue, "1", "1", "2")
+	if d := receive(t, deliveries); d.MessageId != "1" {
+		t.Errorf("expected message 1, got %s", d.MessageId)
+	}
+	if d := receive(t, deliveries); d.MessageId != "2" {
+		t.Errorf("expected the duplicate of message 1 skipped, got %s", d.MessageId)
+	}
+	expectNoDelivery(t, deliveries)
+}
+
+func TestDeduplicateRecordsUnlessNacked(t *testing.T) {
+	b := newTestBroker(t)
+	queue := declareQueue(t, b, &QueueProperties{Name: "orders"})
+	deliveries := make(chan *Delivery, 10)
+	consumeDeduplicated(t, b, queue, &ConsumerProperties{}, func(d *Delivery) {
+		if !d.Redelivered && d.MessageId == "1" {
+			d.Nack(true)
+		} else if d.MessageId != "2" {
+			d.Ack()
+		}
+		deliveries <- d
+	})
+
+	publish(t, b, queue, "1")
+	if d := receive(t, deliveries); d.Redelivered {
+		t.Error("first delivery marked as redelivered")
+	}
+	if d := receive(t, deliveries); !d.Redelivered {
+		t.Error("expected the nacked message handled again on redelivery")
+	}
+
+	// message 2 is never acked by the handler, it is recorded when the handler returns
+	publish(t, b, queue, "2", "1", "2")
+	if d := receive(t, deliveries); d.MessageId != "2" {
+		t.Errorf("expected message 2, got %s", d.MessageId)
+	}
+	expectNoDelivery(t, deliveries)
+}
+
+func TestDeduplicateConsumer(t *testing.T) {
+	acknowledger := &fakeAmqpAcknowledger{}
+	handled := 0
+	p := &RabbitMqConsumerProperties{Deduplication: &DeduplicationProperties{Header: "x-event-id"}}
+	handler := DeduplicateConsumer("orders", p, NewMemoryDeduplicationStore(10, 0), func(channel *amqp.Channel, d *amqp.Delivery) {
+		handled++
+		if handled == 1 {
+			d.Reject(true)
+			return
+		}
+		d.Ack(false)
+	})
+
+	for tag := uint64(1); tag <= 3; tag++ {
+		handler(nil, &amqp.Delivery{
+			Acknowledger: acknowledger,
+			DeliveryTag:  tag,
+			Headers:      amqp.Table{"x-event-id": "event-1"},
+		})
+	}
+	if handled != 2 {
+		t.Errorf("expected the rejected message handled again and the duplicate skipped, handled %d", handled)
+	}
+	expected := []string{"reject 1", "ack 2", "ack 3"}
+	if fmt.Sprint(acknowledger.calls) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, acknowledger.calls)
+	}
+}
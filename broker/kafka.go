@@ -0,0 +1,421 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/spf13/cast"
+
+	"github.com/ivanmtzp/go-microservice/log"
+	"github.com/ivanmtzp/go-microservice/monitoring"
+)
+
+const (
+	KafkaOffsetOldest = "oldest"
+	KafkaOffsetNewest = "newest"
+
+	KafkaCommitAuto = "auto"
+	KafkaCommitSync = "sync"
+
+	kafkaConsumerRetryInterval = time.Second
+)
+
+var _ Broker = (*KafkaBroker)(nil)
+
+type KafkaConsumerProperties struct {
+	GroupId            string
+	Topics             []string
+	InitialOffset      string
+	CommitStrategy     string `config:"commit"`
+	AutoCommitInterval time.Duration
+	Deduplication      *DeduplicationProperties
+}
+
+type kafkaConsumer struct {
+	id         string
+	properties *KafkaConsumerProperties
+	handler    HandlerFunc
+	client     sarama.Client
+	group      sarama.ConsumerGroup
+}
+
+type KafkaBroker struct {
+	brokers   []string
+	clientId  string
+	version   sarama.KafkaVersion
+	client    sarama.Client
+	producer  sarama.SyncProducer
+	consumers map[string]*kafkaConsumer
+	context   context.Context
+	cancel    context.CancelFunc
+}
+
+func NewKafkaBroker(brokers []string, clientId, version string) (*KafkaBroker, error) {
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("no kafka brokers configured")
+	}
+	v := sarama.V1_0_0_0
+	if version != "" {
+		parsed, err := sarama.ParseKafkaVersion(version)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kafka version %s, %s", version, err)
+		}
+		v = parsed
+	}
+	b := &KafkaBroker{
+		brokers:   brokers,
+		clientId:  clientId,
+		version:   v,
+		consumers: make(map[string]*kafkaConsumer),
+	}
+	client, err := sarama.NewClient(brokers, b.config())
+	if err != nil {
+		return nil, err
+	}
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	b.client = client
+	b.producer = producer
+	b.context, b.cancel = context.WithCancel(context.Background())
+	return b, nil
+}
+
+func (b *KafkaBroker) config() *sarama.Config {
+	config := sarama.NewConfig()
+	config.Version = b.version
+	if b.clientId != "" {
+		config.ClientID = b.clientId
+	}
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	return config
+}
+
+func (b *KafkaBroker) Address() string {
+	return strings.Join(b.brokers, ",")
+}
+
+func (b *KafkaBroker) HealthCheck() error {
+	if err := b.client.RefreshMetadata(); err != nil {
+		return err
+	}
+	if _, err := b.client.Controller(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (b *KafkaBroker) Publish(topic, key string, m *Message) error {
+	msg := &sarama.ProducerMessage{
+		Topic:     topic,
+		Value:     sarama.ByteEncoder(m.Body),
+		Headers:   kafkaHeaders(m),
+		Timestamp: m.Timestamp,
+	}
+	if key != "" {
+		msg.Key = sarama.StringEncoder(key)
+	}
+	_, _, err := b.producer.SendMessage(msg)
+	if err != nil {
+		monitoring.IncCounter(fmt.Sprintf("broker.kafka.%s.publish_errors", topic), 1)
+		return err
+	}
+	monitoring.IncCounter(fmt.Sprintf("broker.kafka.%s.published", topic), 1)
+	return nil
+}
+
+// DeclareExchange creates the topic p.Name, Kafka publishes to topics instead of exchanges
+func (b *KafkaBroker) DeclareExchange(p *ExchangeProperties) error {
+	if err := b.createTopic(&QueueProperties{Name: p.Name}); err != nil {
+		return fmt.Errorf("failed to create kafka topic %s, %s", p.Name, err)
+	}
+	return nil
+}
+
+// DeclareQueue creates the topic p.Name. MessageTtl sets its retention and Args its partitions,
+// replication_factor and topic configs such as cleanup.policy.
+func (b *KafkaBroker) DeclareQueue(id string, p *QueueProperties) (string, error) {
+	if p.Name == "" {
+		return "", fmt.Errorf("kafka topic %s without name", id)
+	}
+	if p.AutoDelete || p.Exclusive || p.MaxLength > 0 || p.Overflow != "" || p.DeadLetterExchange != "" {
+		return "", fmt.Errorf("kafka topic %s, auto delete, exclusive, max length, overflow and dead lettering are not supported", id)
+	}
+	if err := b.createTopic(p); err != nil {
+		return "", fmt.Errorf("failed to create kafka topic %s, %s", p.Name, err)
+	}
+	return p.Name, nil
+}
+
+func kafkaTopicDetail(p *QueueProperties) (*sarama.TopicDetail, error) {
+	detail := &sarama.TopicDetail{NumPartitions: 1, ReplicationFactor: 1, ConfigEntries: make(map[string]*string)}
+	for k, v := range p.Args {
+		switch k {
+		case "partitions":
+			n, err := cast.ToIntE(v)
+			if err != nil || n <= 0 || n > 1<<31-1 {
+				return nil, fmt.Errorf("invalid partitions %v", v)
+			}
+			detail.NumPartitions = int32(n)
+		case "replication_factor":
+			n, err := cast.ToIntE(v)
+			if err != nil || n <= 0 || n > 1<<15-1 {
+				return nil, fmt.Errorf("invalid replication factor %v", v)
+			}
+			detail.ReplicationFactor = int16(n)
+		default:
+			value := fmt.Sprint(v)
+			detail.ConfigEntries[k] = &value
+		}
+	}
+	if p.MessageTtl > 0 {
+		retention := strconv.FormatInt(int64(p.MessageTtl/time.Millisecond), 10)
+		detail.ConfigEntries["retention.ms"] = &retention
+	}
+	return detail, nil
+}
+
+func (b *KafkaBroker) createTopic(p *QueueProperties) error {
+	detail, err := kafkaTopicDetail(p)
+	if err != nil {
+		return err
+	}
+	admin, err := sarama.NewClusterAdmin(b.brokers, b.config())
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+	err = admin.CreateTopic(p.Name, detail, false)
+	if topicErr, ok := err.(*sarama.TopicError); ok && topicErr.Err == sarama.ErrTopicAlreadyExists {
+		return nil
+	}
+	return err
+}
+
+// BindQueue is not supported, Kafka consumers read the topics directly
+func (b *KafkaBroker) BindQueue(queueName, key, exchange string) error {
+	return fmt.Errorf("kafka does not support queue bindings, consume topic %s directly", exchange)
+}
+
+// Consume joins the consumer group p.Group, or id when empty, reading the topic p.QueueName with
+// the auto commit strategy. AutoAck acknowledges every message before handling it.
+func (b *KafkaBroker) Consume(id string, handler HandlerFunc, p *ConsumerProperties) error {
+	kp := &KafkaConsumerProperties{GroupId: p.Group, Topics: []string{p.QueueName}}
+	if kp.GroupId == "" {
+		kp.GroupId = id
+	}
+	if p.AutoAck {
+		next := handler
+		handler = func(d *Delivery) {
+			d.Ack()
+			next(d)
+		}
+	}
+	return b.WithConsumer(id, handler, kp)
+}
+
+func (b *KafkaBroker) WithConsumer(id string, handler HandlerFunc, p *KafkaConsumerProperties) error {
+	config, err := b.consumerConfig(id, p)
+	if err != nil {
+		return err
+	}
+	client, err := sarama.NewClient(b.brokers, config)
+	if err != nil {
+		return err
+	}
+	group, err := sarama.NewConsumerGroupFromClient(p.GroupId, client)
+	if err != nil {
+		client.Close()
+		return err
+	}
+	b.consumers[id] = &kafkaConsumer{id: id, properties: p, handler: handler, client: client, group: group}
+	return nil
+}
+
+func (b *KafkaBroker) consumerConfig(id string, p *KafkaConsumerProperties) (*sarama.Config, error) {
+	if p.GroupId == "" {
+		return nil, fmt.Errorf("kafka consumer %s without group id", id)
+	}
+	if len(p.Topics) == 0 {
+		return nil, fmt.Errorf("kafka consumer %s without topics", id)
+	}
+	config := b.config()
+	switch p.InitialOffset {
+	case "", KafkaOffsetNewest:
+		config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	case KafkaOffsetOldest:
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	default:
+		return nil, fmt.Errorf("kafka consumer %s invalid initial offset %s", id, p.InitialOffset)
+	}
+	switch p.CommitStrategy {
+	case "", KafkaCommitAuto:
+		config.Consumer.Offsets.AutoCommit.Enable = true
+		if p.AutoCommitInterval > 0 {
+			config.Consumer.Offsets.AutoCommit.Interval = p.AutoCommitInterval
+		}
+	case KafkaCommitSync:
+		config.Consumer.Offsets.AutoCommit.Enable = false
+	default:
+		return nil, fmt.Errorf("kafka consumer %s invalid commit strategy %s", id, p.CommitStrategy)
+	}
+	return config, nil
+}
+
+func (b *KafkaBroker) consume(c *kafkaConsumer) {
+	for b.context.Err() == nil {
+		ctx, cancel := context.WithCancel(b.context)
+		err := c.group.Consume(ctx, c.properties.Topics, &kafkaGroupHandler{consumer: c, cancel: cancel})
+		cancel()
+		if err == sarama.ErrClosedConsumerGroup {
+			return
+		}
+		if err != nil {
+			monitoring.IncCounter(fmt.Sprintf("broker.kafka.%s.errors", c.id), 1)
+			log.Errorf("kafka consumer %s failed, retrying in %s: %s", c.id, kafkaConsumerRetryInterval, err)
+			select {
+			case <-b.context.Done():
+				return
+			case <-time.After(kafkaConsumerRetryInterval):
+			}
+		}
+	}
+}
+
+func (b *KafkaBroker) Run() {
+	var wg sync.WaitGroup
+	wg.Add(len(b.consumers))
+	for _, v := range b.consumers {
+		go func(c *kafkaConsumer) {
+			defer wg.Done()
+			b.consume(c)
+		}(v)
+	}
+	wg.Wait()
+}
+
+func (b *KafkaBroker) Close() {
+	b.cancel()
+	for _, c := range b.consumers {
+		c.group.Close()
+		c.client.Close()
+	}
+	b.producer.Close()
+	b.client.Close()
+}
+
+type kafkaGroupHandler struct {
+	consumer *kafkaConsumer
+	cancel   context.CancelFunc
+}
+
+func (h *kafkaGroupHandler) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (h *kafkaGroupHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (h *kafkaGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	c := h.consumer
+	for msg := range claim.Messages() {
+		a := &kafkaAcknowledger{consumerId: c.id, session: session, message: msg, commit: c.properties.CommitStrategy == KafkaCommitSync}
+		start := time.Now()
+		c.handler(withLogContext(newKafkaDelivery(c.id, msg, a)))
+		monitoring.UpdateTimerSince(fmt.Sprintf("broker.kafka.%s.handler", c.id), start, time.Millisecond)
+		monitoring.IncCounter(fmt.Sprintf("broker.kafka.%s.consumed", c.id), 1)
+		if a.rewind {
+			h.cancel()
+			return nil
+		}
+	}
+	return nil
+}
+
+type kafkaAcknowledger struct {
+	consumerId string
+	session    sarama.ConsumerGroupSession
+	message    *sarama.ConsumerMessage
+	commit     bool
+	rewind     bool
+}
+
+func (a *kafkaAcknowledger) Ack(tag uint64) error {
+	a.session.MarkMessage(a.message, "")
+	if a.commit {
+		a.session.Commit()
+	}
+	return nil
+}
+
+// Nack with requeue rewinds the partition to the message, so it is consumed again. Kafka has no
+// dead lettering, without requeue the message is dropped: its offset is committed as on Ack and
+// counted in broker.kafka.<consumer>.dropped.
+func (a *kafkaAcknowledger) Nack(tag uint64, requeue bool) error {
+	if !requeue {
+		monitoring.IncCounter(fmt.Sprintf("broker.kafka.%s.dropped", a.consumerId), 1)
+		log.Warningf("kafka consumer %s dropped message %s/%d/%d", a.consumerId, a.message.Topic, a.message.Partition, a.message.Offset)
+		return a.Ack(tag)
+	}
+	a.session.ResetOffset(a.message.Topic, a.message.Partition, a.message.Offset, "")
+	a.rewind = true
+	return nil
+}
+
+func kafkaHeaders(m *Message) []sarama.RecordHeader {
+	var headers []sarama.RecordHeader
+	add := func(key, value string) {
+		if value != "" {
+			headers = append(headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+		}
+	}
+	add("message_id", m.MessageId)
+	add("correlation_id", m.CorrelationId)
+	add("reply_to", m.ReplyTo)
+	add("content_type", m.ContentType)
+	for k, v := range m.Headers {
+		switch value := v.(type) {
+		case []byte:
+			headers = append(headers, sarama.RecordHeader{Key: []byte(k), Value: value})
+		default:
+			add(k, fmt.Sprint(value))
+		}
+	}
+	return headers
+}
+
+func newKafkaDelivery(consumerId string, msg *sarama.ConsumerMessage, a *kafkaAcknowledger) *Delivery {
+	m := Message{Headers: make(map[string]interface{}), Timestamp: msg.Timestamp, Body: msg.Value}
+	for _, h := range msg.Headers {
+		value := string(h.Value)
+		switch string(h.Key) {
+		case "message_id":
+			m.MessageId = value
+		case "correlation_id":
+			m.CorrelationId = value
+		case "reply_to":
+			m.ReplyTo = value
+		case "content_type":
+			m.ContentType = value
+		default:
+			m.Headers[string(h.Key)] = value
+		}
+	}
+	return &Delivery{
+		Message:      m,
+		ConsumerId:   consumerId,
+		Exchange:     msg.Topic,
+		RoutingKey:   string(msg.Key),
+		tag:          uint64(msg.Offset),
+		acknowledger: a,
+	}
+}
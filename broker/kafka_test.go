@@ -0,0 +1,239 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+
+	"github.com/ivanmtzp/go-microservice/monitoring"
+)
+
+type fakeSession struct {
+	marked  []int64
+	commits int
+	resets  []int64
+}
+
+func (s *fakeSession) Claims() map[string][]int32 {
+	return nil
+}
+
+func (s *fakeSession) MemberID() string {
+	return "member"
+}
+
+func (s *fakeSession) GenerationID() int32 {
+	return 1
+}
+
+func (s *fakeSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.marked = append(s.marked, offset)
+}
+
+func (s *fakeSession) Commit() {
+	s.commits++
+}
+
+func (s *fakeSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {
+	s.resets = append(s.resets, offset)
+}
+
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+func (s *fakeSession) Context() context.Context {
+	return context.Background()
+}
+
+type fakeClaim struct {
+	messages chan *sarama.ConsumerMessage
+}
+
+func newFakeClaim(offsets ...int64) *fakeClaim {
+	c := &fakeClaim{messages: make(chan *sarama.ConsumerMessage, len(offsets))}
+	for _, offset := range offsets {
+		c.messages <- &sarama.ConsumerMessage{Topic: "orders", Partition: 0, Offset: offset, Value: []byte(fmt.Sprint(offset))}
+	}
+	close(c.messages)
+	return c
+}
+
+func (c *fakeClaim) Topic() string {
+	return "orders"
+}
+
+func (c *fakeClaim) Partition() int32 {
+	return 0
+}
+
+func (c *fakeClaim) InitialOffset() int64 {
+	return 0
+}
+
+func (c *fakeClaim) HighWaterMarkOffset() int64 {
+	return 0
+}
+
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
+
+func consumeFakeClaim(t *testing.T, p *KafkaConsumerProperties, handler HandlerFunc, offsets ...int64) (*fakeSession, bool) {
+	session := &fakeSession{}
+	cancelled := false
+	h := &kafkaGroupHandler{
+		consumer: &kafkaConsumer{id: "orders", properties: p, handler: handler},
+		cancel:   func() { cancelled = true },
+	}
+	if err := h.ConsumeClaim(session, newFakeClaim(offsets...)); err != nil {
+		t.Fatalf("consume claim failed: %s", err)
+	}
+	return session, cancelled
+}
+
+func counter(t *testing.T, name string) int64 {
+	var buffer bytes.Buffer
+	monitoring.WriteJsonMetrics(&buffer)
+	var metrics map[string]map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &metrics); err != nil {
+		t.Fatalf("invalid metrics json: %s", err)
+	}
+	count, _ := metrics[name]["count"].(float64)
+	return int64(count)
+}
+
+func TestKafkaNackRequeueResetsOffset(t *testing.T) {
+	var handled []int64
+	session, cancelled := consumeFakeClaim(t, &KafkaConsumerProperties{}, func(d *Delivery) {
+		handled = append(handled, int64(d.tag))
+		if d.tag == 11 {
+			d.Nack(true)
+			return
+		}
+		d.Ack()
+	}, 10, 11, 12)
+
+	if len(handled) != 2 || handled[1] != 11 {
+		t.Errorf("expected the claim to stop at the nacked offset 11, handled %v", handled)
+	}
+	if len(session.resets) != 1 || session.resets[0] != 11 {
+		t.Errorf("expected offset reset to 11, got %v", session.resets)
+	}
+	if len(session.marked) != 1 || session.marked[0] != 11 {
+		t.Errorf("expected only offset 10 marked, got %v", session.marked)
+	}
+	if !cancelled {
+		t.Error("expected the session to be cancelled to consume from the reset offset")
+	}
+}
+
+func TestKafkaNackWithoutRequeueDrops(t *testing.T) {
+	dropped := counter(t, "broker.kafka.orders.dropped")
+	session, cancelled := consumeFakeClaim(t, &KafkaConsumerProperties{}, func(d *Delivery) {
+		d.Nack(false)
+	}, 5)
+
+	if len(session.resets) != 0 || cancelled {
+		t.Errorf("expected no rewind, resets %v, cancelled %t", session.resets, cancelled)
+	}
+	if len(session.marked) != 1 || session.marked[0] != 6 {
+		t.Errorf("expected the dropped message to be marked, got %v", session.marked)
+	}
+	if got := counter(t, "broker.kafka.orders.dropped") - dropped; got != 1 {
+		t.Errorf("expected 1 dropped message counted, got %d", got)
+	}
+}
+
+func TestKafkaCommitStrategy(t *testing.T) {
+	tests := []struct {
+		strategy   string
+		autoCommit bool
+		commits    int
+	}{
+		{strategy: "", autoCommit: true, commits: 0},
+		{strategy: KafkaCommitAuto, autoCommit: true, commits: 0},
+		{strategy: KafkaCommitSync, autoCommit: false, commits: 2},
+	}
+	b := &KafkaBroker{version: sarama.V1_0_0_0}
+	for _, test := range tests {
+		p := &KafkaConsumerProperties{GroupId: "group", Topics: []string{"orders"}, CommitStrategy: test.strategy, AutoCommitInterval: 3 * time.Second}
+		config, err := b.consumerConfig("orders", p)
+		if err != nil {
+			t.Fatalf("strategy %q, unexpected error %s", test.strategy, err)
+		}
+		if config.Consumer.Offsets.AutoCommit.Enable != test.autoCommit {
+			t.Errorf("strategy %q, expected auto commit %t", test.strategy, test.autoCommit)
+		}
+		if test.autoCommit && config.Consumer.Offsets.AutoCommit.Interval != 3*time.Second {
+			t.Errorf("strategy %q, expected auto commit interval 3s, got %s", test.strategy, config.Consumer.Offsets.AutoCommit.Interval)
+		}
+		session, _ := consumeFakeClaim(t, p, func(d *Delivery) {
+			d.Ack()
+		}, 1, 2)
+		if session.commits != test.commits {
+			t.Errorf("strategy %q, expected %d commits, got %d", test.strategy, test.commits, session.commits)
+		}
+	}
+
+	if _, err := b.consumerConfig("orders", &KafkaConsumerProperties{GroupId: "group", Topics: []string{"orders"}, CommitStrategy: "async"}); err == nil {
+		t.Error("expected unknown commit strategy to fail")
+	}
+}
+
+func TestKafkaHeadersRoundTrip(t *testing.T) {
+	m := &Message{
+		MessageId:     "message-1",
+		CorrelationId: "correlation-1",
+		ReplyTo:       "replies",
+		ContentType:   "application/json",
+		Headers:       map[string]interface{}{"x-request-id": "request-1", "attempt": 3, "signature": []byte("raw")},
+		Body:          []byte(`{"id":1}`),
+	}
+	var headers []*sarama.RecordHeader
+	for _, h := range kafkaHeaders(m) {
+		header := h
+		headers = append(headers, &header)
+	}
+	msg := &sarama.ConsumerMessage{Topic: "orders", Key: []byte("key-1"), Offset: 7, Headers: headers, Value: m.Body}
+	d := newKafkaDelivery("orders", msg, &kafkaAcknowledger{})
+
+	if d.MessageId != m.MessageId || d.CorrelationId != m.CorrelationId || d.ReplyTo != m.ReplyTo || d.ContentType != m.ContentType {
+		t.Errorf("message properties not preserved, got %+v", d.Message)
+	}
+	expected := map[string]interface{}{"x-request-id": "request-1", "attempt": "3", "signature": "raw"}
+	if fmt.Sprint(d.Headers) != fmt.Sprint(expected) {
+		t.Errorf("expected headers %v, got %v", expected, d.Headers)
+	}
+	if d.Exchange != "orders" || d.RoutingKey != "key-1" || string(d.Body) != `{"id":1}` {
+		t.Errorf("unexpected delivery %+v", d)
+	}
+}
+
+func TestKafkaPublish(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	b := &KafkaBroker{producer: producer}
+	producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(value []byte) error {
+		if string(value) != "body" {
+			return fmt.Errorf("unexpected value %s", value)
+		}
+		return nil
+	})
+	producer.ExpectSendMessageAndFail(sarama.ErrOutOfBrokers)
+
+	if err := b.Publish("orders", "key", &Message{Body: []byte("body")}); err != nil {
+		t.Errorf("unexpected publish error %s", err)
+	}
+	if err := b.Publish("orders", "key", &Message{Body: []byte("body")}); err != sarama.ErrOutOfBrokers {
+		t.Errorf("expected out of brokers error, got %v", err)
+	}
+	if err := producer.Close(); err != nil {
+		t.Error(err)
+	}
+}
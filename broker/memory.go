@@ -0,0 +1,402 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var _ Broker = (*InMemoryBroker)(nil)
+
+type memoryExchange struct {
+	properties *ExchangeProperties
+	bindings   []memoryBinding
+}
+
+type memoryBinding struct {
+	queue string
+	key   string
+}
+
+type memoryMessage struct {
+	Message
+	exchange    string
+	key         string
+	redelivered bool
+}
+
+type memoryQueue struct {
+	name       string
+	properties *RabbitMqQueueProperties
+	messages   []*memoryMessage
+	consumers  []*memoryConsumer
+	next       int
+}
+
+type memoryConsumer struct {
+	id         string
+	broker     *InMemoryBroker
+	queue      *memoryQueue
+	handler    HandlerFunc
+	properties *RabbitMqConsumerProperties
+	unacked    map[uint64]*memoryMessage
+	pending    []*Delivery
+	signal     chan struct{}
+}
+
+type InMemoryBroker struct {
+	mutex     sync.Mutex
+	exchanges map[string]*memoryExchange
+	queues    map[string]*memoryQueue
+	queueIds  map[string]string
+	consumers map[string]*memoryConsumer
+	tag       uint64
+	generated int
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewInMemoryBroker() *InMemoryBroker {
+	return &InMemoryBroker{
+		exchanges: map[string]*memoryExchange{
+			"": {properties: &ExchangeProperties{Kind: DirectExchange, Durable: true}},
+		},
+		queues:    make(map[string]*memoryQueue),
+		queueIds:  make(map[string]string),
+		consumers: make(map[string]*memoryConsumer),
+		done:      make(chan struct{}),
+	}
+}
+
+func (b *InMemoryBroker) Address() string {
+	return "memory"
+}
+
+func (b *InMemoryBroker) DeclareExchange(p *ExchangeProperties) error {
+	switch p.Kind {
+	case DirectExchange, TopicExchange, FanoutExchange:
+	default:
+		return fmt.Errorf("unsupported exchange kind %s", p.Kind)
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if e, ok := b.exchanges[p.Name]; ok {
+		if e.properties.Kind != p.Kind || e.properties.Durable != p.Durable || e.properties.AutoDelete != p.AutoDelete {
+			return fmt.Errorf("exchange %s already exists with different properties", p.Name)
+		}
+		return nil
+	}
+	b.exchanges[p.Name] = &memoryExchange{properties: p}
+	return nil
+}
+
+// DeclareQueue emulates a RabbitMQ queue, validating the properties as RabbitMQ would
+func (b *InMemoryBroker) DeclareQueue(id string, qp *QueueProperties) (string, error) {
+	p := newRabbitMqQueueProperties(qp)
+	args, err := p.Arguments()
+	if err != nil {
+		return "", fmt.Errorf("invalid properties for queue %s, %s", id, err)
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	name := p.Name
+	if name == "" {
+		b.generated++
+		name = fmt.Sprintf("amq.gen-%d", b.generated)
+	}
+	if q, ok := b.queues[name]; ok {
+		existing, _ := q.properties.Arguments()
+		if q.properties.Durable != p.Durable || q.properties.AutoDelete != p.AutoDelete ||
+			q.properties.Exclusive != p.Exclusive || fmt.Sprint(existing) != fmt.Sprint(args) {
+			return "", fmt.Errorf("queue %s (%s) already exists with different properties", id, name)
+		}
+	} else {
+		b.queues[name] = &memoryQueue{name: name, properties: p}
+	}
+	b.queueIds[id] = name
+	return name, nil
+}
+
+func (b *InMemoryBroker) resolveQueueName(queueName string) (string, error) {
+	if strings.HasPrefix(queueName, "nameFromQueue(") && strings.HasSuffix(queueName, ")") {
+		queueId := strings.TrimPrefix(strings.TrimSuffix(queueName, ")"), "nameFromQueue(")
+		name, ok := b.queueIds[queueId]
+		if !ok {
+			return "", fmt.Errorf("unable to find queue name for queue id %s", queueId)
+		}
+		return name, nil
+	}
+	if _, ok := b.queues[queueName]; !ok {
+		return "", fmt.Errorf("queue %s not found", queueName)
+	}
+	return queueName, nil
+}
+
+func (b *InMemoryBroker) BindQueue(queueName, key, exchange string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	name, err := b.resolveQueueName(queueName)
+	if err != nil {
+		return err
+	}
+	if exchange == "" {
+		return fmt.Errorf("binding queue %s to the default exchange is not allowed", name)
+	}
+	e, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("exchange %s not found", exchange)
+	}
+	for _, binding := range e.bindings {
+		if binding.queue == name && binding.key == key {
+			return nil
+		}
+	}
+	e.bindings = append(e.bindings, memoryBinding{queue: name, key: key})
+	return nil
+}
+
+func (b *InMemoryBroker) Publish(exchange, key string, m *Message) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.route(&memoryMessage{Message: *m, exchange: exchange, key: key})
+}
+
+func (b *InMemoryBroker) route(m *memoryMessage) error {
+	e, ok := b.exchanges[m.exchange]
+	if !ok {
+		return fmt.Errorf("exchange %s not found", m.exchange)
+	}
+	if m.exchange == "" {
+		if q, ok := b.queues[m.key]; ok {
+			b.enqueue(q, m)
+		}
+		return nil
+	}
+	routed := make(map[string]bool)
+	for _, binding := range e.bindings {
+		if routed[binding.queue] || !bindingMatches(e.properties.Kind, binding.key, m.key) {
+			continue
+		}
+		if q, ok := b.queues[binding.queue]; ok {
+			routed[binding.queue] = true
+			copied := *m
+			b.enqueue(q, &copied)
+		}
+	}
+	return nil
+}
+
+func bindingMatches(kind, bindingKey, routingKey string) bool {
+	switch kind {
+	case FanoutExchange:
+		return true
+	case TopicExchange:
+		return topicMatches(strings.Split(bindingKey, "."), strings.Split(routingKey, "."))
+	default:
+		return bindingKey == routingKey
+	}
+}
+
+func topicMatches(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatches(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && topicMatches(pattern[1:], words[1:])
+	}
+}
+
+func (b *InMemoryBroker) enqueue(q *memoryQueue, m *memoryMessage) {
+	if max := q.properties.MaxLength; max > 0 && len(q.messages) >= max {
+		switch q.properties.Overflow {
+		case OverflowRejectPublish:
+			return
+		case OverflowRejectPublishDlx:
+			b.deadLetter(q, m)
+			return
+		default:
+			dropped := q.messages[0]
+			q.messages = q.messages[1:]
+			b.deadLetter(q, dropped)
+		}
+	}
+	q.messages = append(q.messages, m)
+	b.dispatch(q)
+}
+
+func (b *InMemoryBroker) deadLetter(q *memoryQueue, m *memoryMessage) {
+	exchange := q.properties.DeadLetterExchange
+	if exchange == "" {
+		return
+	}
+	key := q.properties.DeadLetterRoutingKey
+	if key == "" {
+		key = m.key
+	}
+	b.route(&memoryMessage{Message: m.Message, exchange: exchange, key: key})
+}
+
+func (b *InMemoryBroker) dispatch(q *memoryQueue) {
+	for len(q.messages) > 0 {
+		c := q.nextConsumer()
+		if c == nil {
+			return
+		}
+		m := q.messages[0]
+		q.messages = q.messages[1:]
+		b.tag++
+		if !c.properties.AutoAck {
+			c.unacked[b.tag] = m
+		}
+		d := &Delivery{
+			Message:     m.Message,
+			ConsumerId:  c.id,
+			Exchange:    m.exchange,
+			RoutingKey:  m.key,
+			Redelivered: m.redelivered,
+			tag:         b.tag,
+		}
+		if !c.properties.AutoAck {
+			d.acknowledger = c
+		}
+		c.pending = append(c.pending, d)
+		select {
+		case c.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (q *memoryQueue) nextConsumer() *memoryConsumer {
+	for i := 0; i < len(q.consumers); i++ {
+		c := q.consumers[(q.next+i)%len(q.consumers)]
+		if c.ready() {
+			q.next = (q.next + i + 1) % len(q.consumers)
+			return c
+		}
+	}
+	return nil
+}
+
+func (c *memoryConsumer) ready() bool {
+	prefetch := c.properties.PrefetchCount
+	return c.properties.AutoAck || prefetch <= 0 || len(c.unacked) < prefetch
+}
+
+func (c *memoryConsumer) Ack(tag uint64) error {
+	c.broker.mutex.Lock()
+	defer c.broker.mutex.Unlock()
+	if _, ok := c.unacked[tag]; !ok {
+		return fmt.Errorf("unknown delivery tag %d for consumer %s", tag, c.id)
+	}
+	delete(c.unacked, tag)
+	c.broker.dispatch(c.queue)
+	return nil
+}
+
+func (c *memoryConsumer) Nack(tag uint64, requeue bool) error {
+	c.broker.mutex.Lock()
+	defer c.broker.mutex.Unlock()
+	m, ok := c.unacked[tag]
+	if !ok {
+		return fmt.Errorf("unknown delivery tag %d for consumer %s", tag, c.id)
+	}
+	delete(c.unacked, tag)
+	if requeue {
+		m.redelivered = true
+		c.queue.messages = append([]*memoryMessage{m}, c.queue.messages...)
+	} else {
+		c.broker.deadLetter(c.queue, m)
+	}
+	c.broker.dispatch(c.queue)
+	return nil
+}
+
+func (b *InMemoryBroker) Consume(id string, handler HandlerFunc, cp *ConsumerProperties) error {
+	p := newRabbitMqConsumerProperties(cp)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	name, err := b.resolveQueueName(p.QueueName)
+	if err != nil {
+		return err
+	}
+	if _, ok := b.consumers[id]; ok {
+		return fmt.Errorf("consumer %s already registered", id)
+	}
+	q := b.queues[name]
+	c := &memoryConsumer{
+		id:         id,
+		broker:     b,
+		queue:      q,
+		handler:    handler,
+		properties: p,
+		unacked:    make(map[uint64]*memoryMessage),
+		signal:     make(chan struct{}, 1),
+	}
+	b.consumers[id] = c
+	q.consumers = append(q.consumers, c)
+	b.dispatch(q)
+	return nil
+}
+
+func (b *InMemoryBroker) QueueLength(queueName string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	name, err := b.resolveQueueName(queueName)
+	if err != nil {
+		return 0
+	}
+	return len(b.queues[name].messages)
+}
+
+func (c *memoryConsumer) run() {
+	for {
+		select {
+		case <-c.broker.done:
+			return
+		case <-c.signal:
+		}
+		c.broker.mutex.Lock()
+		pending := c.pending
+		c.pending = nil
+		c.broker.mutex.Unlock()
+		for _, d := range pending {
+			c.handler(withLogContext(d))
+		}
+	}
+}
+
+func (b *InMemoryBroker) Run() {
+	b.mutex.Lock()
+	consumers := make([]*memoryConsumer, 0, len(b.consumers))
+	for _, c := range b.consumers {
+		consumers = append(consumers, c)
+	}
+	b.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(consumers))
+	for _, c := range consumers {
+		go func(c *memoryConsumer) {
+			defer wg.Done()
+			c.run()
+		}(c)
+	}
+	wg.Wait()
+}
+
+func (b *InMemoryBroker) Close() {
+	b.closeOnce.Do(func() {
+		close(b.done)
+	})
+}
@@ -0,0 +1,182 @@
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBroker(t *testing.T) *InMemoryBroker {
+	b := NewInMemoryBroker()
+	t.Cleanup(b.Close)
+	return b
+}
+
+func declareQueue(t *testing.T, b *InMemoryBroker, p *QueueProperties) string {
+	name, err := b.DeclareQueue(p.Name, p)
+	if err != nil {
+		t.Fatalf("declare queue %s failed: %s", p.Name, err)
+	}
+	return name
+}
+
+func consume(t *testing.T, b *InMemoryBroker, queueName string, p *ConsumerProperties) chan *Delivery {
+	deliveries := make(chan *Delivery, 10)
+	p.QueueName = queueName
+	if err := b.Consume(queueName, func(d *Delivery) { deliveries <- d }, p); err != nil {
+		t.Fatalf("consume %s failed: %s", queueName, err)
+	}
+	return deliveries
+}
+
+func receive(t *testing.T, deliveries chan *Delivery) *Delivery {
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("delivery not received")
+		return nil
+	}
+}
+
+func expectNoDelivery(t *testing.T, deliveries chan *Delivery) {
+	select {
+	case d := <-deliveries:
+		t.Fatalf("unexpected delivery %s", d.MessageId)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestInMemoryBrokerTopicMatching(t *testing.T) {
+	tests := []struct {
+		binding string
+		key     string
+		matches bool
+	}{
+		{binding: "orders.*", key: "orders.created", matches: true},
+		{binding: "orders.*", key: "orders.created.eu", matches: false},
+		{binding: "orders.*", key: "orders", matches: false},
+		{binding: "*.created", key: "orders.created", matches: true},
+		{binding: "*.created", key: "created", matches: false},
+		{binding: "orders.#", key: "orders", matches: true},
+		{binding: "orders.#", key: "orders.created.eu", matches: true},
+		{binding: "#", key: "any.routing.key", matches: true},
+		{binding: "orders.#.eu", key: "orders.eu", matches: true},
+		{binding: "orders.#.eu", key: "orders.created.eu", matches: true},
+		{binding: "orders.#.eu", key: "orders.created.us", matches: false},
+		{binding: "orders.created", key: "orders.updated", matches: false},
+	}
+	for _, test := range tests {
+		b := newTestBroker(t)
+		if err := b.DeclareExchange(&ExchangeProperties{Name: "events", Kind: TopicExchange}); err != nil {
+			t.Fatal(err)
+		}
+		queue := declareQueue(t, b, &QueueProperties{Name: "orders"})
+		if err := b.BindQueue(queue, test.binding, "events"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Publish("events", test.key, &Message{MessageId: "1"}); err != nil {
+			t.Fatal(err)
+		}
+		if routed := b.QueueLength(queue) == 1; routed != test.matches {
+			t.Errorf("binding %s with key %s, expected match %t", test.binding, test.key, test.matches)
+		}
+	}
+}
+
+func TestInMemoryBrokerPrefetch(t *testing.T) {
+	b := newTestBroker(t)
+	queue := declareQueue(t, b, &QueueProperties{Name: "orders"})
+	for _, id := range []string{"1", "2", "3"} {
+		if err := b.Publish("", queue, &Message{MessageId: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliveries := consume(t, b, queue, &ConsumerProperties{PrefetchCount: 1})
+	go b.Run()
+
+	first := receive(t, deliveries)
+	expectNoDelivery(t, deliveries)
+	if n := b.QueueLength(queue); n != 2 {
+		t.Errorf("expected 2 messages waiting for the unacked one, got %d", n)
+	}
+	if err := first.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if second := receive(t, deliveries); second.MessageId != "2" {
+		t.Errorf("expected message 2 after the ack, got %s", second.MessageId)
+	}
+	expectNoDelivery(t, deliveries)
+}
+
+func TestInMemoryBrokerNackRequeue(t *testing.T) {
+	b := newTestBroker(t)
+	queue := declareQueue(t, b, &QueueProperties{Name: "orders"})
+	deliveries := consume(t, b, queue, &ConsumerProperties{})
+	go b.Run()
+	if err := b.Publish("", queue, &Message{MessageId: "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first := receive(t, deliveries)
+	if first.Redelivered {
+		t.Error("first delivery marked as redelivered")
+	}
+	if err := first.Nack(true); err != nil {
+		t.Fatal(err)
+	}
+	second := receive(t, deliveries)
+	if second.MessageId != "1" || !second.Redelivered {
+		t.Errorf("expected message 1 redelivered, got %s redelivered %t", second.MessageId, second.Redelivered)
+	}
+	if err := second.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	expectNoDelivery(t, deliveries)
+}
+
+func TestInMemoryBrokerDeadLetterOnOverflow(t *testing.T) {
+	tests := []struct {
+		overflow string
+		kept     string
+		dead     string
+	}{
+		{overflow: "", kept: "2", dead: "1"},
+		{overflow: OverflowDropHead, kept: "2", dead: "1"},
+		{overflow: OverflowRejectPublishDlx, kept: "1", dead: "2"},
+	}
+	for _, test := range tests {
+		b := newTestBroker(t)
+		if err := b.DeclareExchange(&ExchangeProperties{Name: "dlx", Kind: DirectExchange}); err != nil {
+			t.Fatal(err)
+		}
+		dead := declareQueue(t, b, &QueueProperties{Name: "dead"})
+		if err := b.BindQueue(dead, "dead", "dlx"); err != nil {
+			t.Fatal(err)
+		}
+		queue := declareQueue(t, b, &QueueProperties{
+			Name:                 "orders",
+			MaxLength:            1,
+			Overflow:             test.overflow,
+			DeadLetterExchange:   "dlx",
+			DeadLetterRoutingKey: "dead",
+		})
+		for _, id := range []string{"1", "2"} {
+			if err := b.Publish("", queue, &Message{MessageId: id}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		keptDeliveries := consume(t, b, queue, &ConsumerProperties{AutoAck: true})
+		deadDeliveries := consume(t, b, dead, &ConsumerProperties{AutoAck: true})
+		go b.Run()
+
+		kept := receive(t, keptDeliveries)
+		if kept.MessageId != test.kept {
+			t.Errorf("overflow %q, expected message %s kept, got %s", test.overflow, test.kept, kept.MessageId)
+		}
+		deadLettered := receive(t, deadDeliveries)
+		if deadLettered.MessageId != test.dead || deadLettered.RoutingKey != "dead" {
+			t.Errorf("overflow %q, expected message %s dead lettered, got %s with key %s", test.overflow, test.dead, deadLettered.MessageId, deadLettered.RoutingKey)
+		}
+	}
+}
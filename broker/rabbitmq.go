@@ -0,0 +1,541 @@
+package broker
+
+import (
+	"github.com/streadway/amqp"
+	"sync"
+	"strings"
+	"fmt"
+	"time"
+
+	"github.com/ivanmtzp/go-microservice/config"
+	"github.com/ivanmtzp/go-microservice/log"
+)
+
+const consumerRecoveryInterval = time.Second
+
+var _ Broker = (*RabbitMqBroker)(nil)
+
+type RabbitMqQueueProperties struct {
+	Name string
+	Durable bool
+	AutoDelete bool
+	Exclusive bool
+	NoWait bool
+	Type string
+	// MessageTtl and Expires are sent to RabbitMQ in milliseconds, they need a unit like 60s
+	// because a bare integer is read as nanoseconds
+	MessageTtl time.Duration
+	Expires time.Duration
+	MaxLength int
+	MaxLengthBytes int
+	Overflow string
+	DeadLetterExchange string
+	DeadLetterRoutingKey string
+	Args map[string]interface{}
+}
+
+type RabbitMqConsumerProperties struct {
+	Name string
+	QueueName string
+	AutoAck bool
+	Exclusive bool
+	NoLocal bool
+	NoWait bool
+	PrefetchCount int `config:"qos.prefetch_count"`
+	PrefetchSize int `config:"qos.prefetch_size"`
+	Deduplication *DeduplicationProperties
+}
+
+// QueueProperties returns the broker neutral properties, passing the RabbitMQ only settings as
+// x- arguments. NoWait can't be expressed and is rejected.
+func (p *RabbitMqQueueProperties) QueueProperties() (*QueueProperties, error) {
+	if p.NoWait {
+		return nil, fmt.Errorf("no_wait not supported by broker neutral queues")
+	}
+	args := make(map[string]interface{}, len(p.Args)+3)
+	for k, v := range p.Args {
+		args[k] = v
+	}
+	if p.Type != "" {
+		args["x-queue-type"] = p.Type
+	}
+	if p.Expires > 0 {
+		args["x-expires"] = int64(p.Expires / time.Millisecond)
+	}
+	if p.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = int64(p.MaxLengthBytes)
+	}
+	return &QueueProperties{
+		Name: p.Name,
+		Durable: p.Durable,
+		AutoDelete: p.AutoDelete,
+		Exclusive: p.Exclusive,
+		MessageTtl: p.MessageTtl,
+		MaxLength: p.MaxLength,
+		Overflow: p.Overflow,
+		DeadLetterExchange: p.DeadLetterExchange,
+		DeadLetterRoutingKey: p.DeadLetterRoutingKey,
+		Args: args,
+	}, nil
+}
+
+// newRabbitMqQueueProperties reads back the x- arguments set by QueueProperties, so quorum
+// queues are validated as such
+func newRabbitMqQueueProperties(p *QueueProperties) *RabbitMqQueueProperties {
+	rp := &RabbitMqQueueProperties{
+		Name: p.Name,
+		Durable: p.Durable,
+		AutoDelete: p.AutoDelete,
+		Exclusive: p.Exclusive,
+		MessageTtl: p.MessageTtl,
+		MaxLength: p.MaxLength,
+		Overflow: p.Overflow,
+		DeadLetterExchange: p.DeadLetterExchange,
+		DeadLetterRoutingKey: p.DeadLetterRoutingKey,
+		Args: make(map[string]interface{}, len(p.Args)),
+	}
+	for k, v := range p.Args {
+		switch value := v.(type) {
+		case string:
+			if k == "x-queue-type" {
+				rp.Type = value
+				continue
+			}
+		case int64:
+			if k == "x-expires" {
+				rp.Expires = time.Duration(value) * time.Millisecond
+				continue
+			}
+			if k == "x-max-length-bytes" {
+				rp.MaxLengthBytes = int(value)
+				continue
+			}
+		}
+		rp.Args[k] = v
+	}
+	return rp
+}
+
+// ConsumerProperties returns the broker neutral properties, the prefetch size, no_local and
+// no_wait can't be expressed and are rejected. Deduplication is left to the caller, which
+// wraps the handler with Deduplicate.
+func (p *RabbitMqConsumerProperties) ConsumerProperties() (*ConsumerProperties, error) {
+	if p.PrefetchSize != 0 || p.NoLocal || p.NoWait {
+		return nil, fmt.Errorf("prefetch size, no_local and no_wait not supported by broker neutral consumers")
+	}
+	return &ConsumerProperties{
+		Name: p.Name,
+		QueueName: p.QueueName,
+		AutoAck: p.AutoAck,
+		Exclusive: p.Exclusive,
+		PrefetchCount: p.PrefetchCount,
+	}, nil
+}
+
+func newRabbitMqConsumerProperties(p *ConsumerProperties) *RabbitMqConsumerProperties {
+	return &RabbitMqConsumerProperties{
+		Name: p.Name,
+		QueueName: p.QueueName,
+		AutoAck: p.AutoAck,
+		Exclusive: p.Exclusive,
+		PrefetchCount: p.PrefetchCount,
+	}
+}
+
+type ConsumerHandlerFunc func(channel *amqp.Channel, delivery *amqp.Delivery)
+
+type ConsumerChannel struct {
+	id string
+	queueName string
+	properties *RabbitMqConsumerProperties
+	handler ConsumerHandlerFunc
+
+	// channel, deliveries and closed are replaced when the channel is recovered
+	mutex sync.Mutex
+	channel *amqp.Channel
+	deliveries <-chan amqp.Delivery
+	closed chan *amqp.Error
+}
+
+func (c *ConsumerChannel) current() (*amqp.Channel, <-chan amqp.Delivery, chan *amqp.Error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.channel, c.deliveries, c.closed
+}
+
+type RabbitMqBroker struct {
+	address string
+	connection *amqp.Connection
+	channelMutex sync.RWMutex
+	channel *amqp.Channel
+	queues map[string]*amqp.Queue
+	consumers map[string]*ConsumerChannel
+	done chan struct{}
+	closeOnce sync.Once
+}
+
+
+func NewRabbitMqBroker(address string) (*RabbitMqBroker, error) {
+	connection, err := amqp.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := connection.Channel()
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return &RabbitMqBroker{
+		address: address,
+		connection: connection,
+		channel:channel,
+		queues: make(map[string]*amqp.Queue),
+		consumers: make(map[string]*ConsumerChannel),
+		done: make(chan struct{})}, nil
+}
+
+func (b *RabbitMqBroker) Address() string {
+	return config.RedactURL(b.address)
+}
+
+// Channel returns the channel used to declare and publish. A failed queue declaration closes
+// it and the broker replaces it, so get it again instead of keeping it.
+func (b *RabbitMqBroker) Channel() *amqp.Channel {
+	b.channelMutex.RLock()
+	defer b.channelMutex.RUnlock()
+	return b.channel
+}
+
+func (b *RabbitMqBroker) Queue(id string) (*amqp.Queue, bool) {
+	q, ok := b.queues[id]
+	return q, ok
+}
+
+func (b *RabbitMqBroker) ConsumerChannel(id string) (*amqp.Channel, bool) {
+	c, ok := b.consumers[id]
+	if !ok {
+		return nil, false
+	}
+	channel, _, _ := c.current()
+	return channel, true
+}
+
+func (b *RabbitMqBroker) WithQueue(id string, p *RabbitMqQueueProperties) (*amqp.Queue, error) {
+	args, err := p.Arguments()
+	if err != nil {
+		return nil, fmt.Errorf("invalid properties for queue %s, %s", id, err)
+	}
+	queue, err := b.Channel().QueueDeclare( p.Name, p.Durable, p.AutoDelete, p.Exclusive, p.NoWait, args)
+	if err != nil {
+		if amqpErr, ok := err.(*amqp.Error); ok && amqpErr.Code == amqp.PreconditionFailed {
+			if reopenErr := b.reopenChannel(); reopenErr != nil {
+				log.Errorf("failed to reopen rabbitmq channel: %s", reopenErr)
+			}
+			return nil, fmt.Errorf("queue %s (%s) already exists with different properties, %s", id, p.Name, amqpErr.Reason)
+		}
+		return nil, err
+	}
+	b.queues[id] = &queue
+	return &queue, nil
+}
+
+func (b *RabbitMqBroker) reopenChannel() error {
+	channel, err := b.connection.Channel()
+	if err != nil {
+		return err
+	}
+	b.channelMutex.Lock()
+	old := b.channel
+	b.channel = channel
+	b.channelMutex.Unlock()
+	// the server already closed it on the failed declaration, release it on our side
+	old.Close()
+	return nil
+}
+
+func (b *RabbitMqBroker) resolveQueueName(queueName string) (string, error) {
+	if strings.HasPrefix(queueName, "nameFromQueue(") && strings.HasSuffix(queueName, ")") {
+		queueId := strings.TrimPrefix(strings.TrimSuffix(queueName, ")"), "nameFromQueue(")
+		q, ok := b.queues[queueId]
+		if !ok {
+			return "", fmt.Errorf("unable to find queue name for queue id %s", queueId)
+		}
+		return q.Name, nil
+	}
+	return queueName, nil
+}
+
+func (b *RabbitMqBroker) WithConsumerChannel(id string, handler ConsumerHandlerFunc, p *RabbitMqConsumerProperties) (<-chan amqp.Delivery, error) {
+	queueName, err := b.resolveQueueName(p.QueueName)
+	if err != nil {
+		return nil, err
+	}
+	c := &ConsumerChannel{
+		id: id,
+		queueName: queueName,
+		properties: p,
+		handler: handler,
+	}
+	if err := b.openConsumerChannel(c); err != nil {
+		return nil, fmt.Errorf("failed to open channel for consumer %s, %s", id, err)
+	}
+	b.consumers[id] = c
+	_, deliveries, _ := c.current()
+	return deliveries, nil
+}
+
+func (b *RabbitMqBroker) openConsumerChannel(c *ConsumerChannel) error {
+	channel, err := b.connection.Channel()
+	if err != nil {
+		return err
+	}
+	p := c.properties
+	if err := channel.Qos(p.PrefetchCount, p.PrefetchSize, false); err != nil {
+		channel.Close()
+		return err
+	}
+	deliveries, err := channel.Consume(c.queueName, p.Name, p.AutoAck, p.Exclusive, p.NoLocal, p.NoWait, nil)
+	if err != nil {
+		channel.Close()
+		return err
+	}
+	closed := channel.NotifyClose(make(chan *amqp.Error, 1))
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.channel = channel
+	c.deliveries = deliveries
+	c.closed = closed
+	return nil
+}
+
+func (b *RabbitMqBroker) closing() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return b.connection.IsClosed()
+	}
+}
+
+func (b *RabbitMqBroker) recoverConsumerChannel(c *ConsumerChannel) bool {
+	for !b.closing() {
+		err := b.openConsumerChannel(c)
+		if err == nil && b.closing() {
+			// Close may have run while the channel was opened
+			channel, _, _ := c.current()
+			channel.Close()
+			return false
+		}
+		if err == nil {
+			log.Infof("rabbitmq consumer %s channel recovered", c.id)
+			return true
+		}
+		log.Warningf("rabbitmq consumer %s channel recovery failed, retrying in %s: %s", c.id, consumerRecoveryInterval, err)
+		select {
+		case <-b.done:
+			return false
+		case <-time.After(consumerRecoveryInterval):
+		}
+	}
+	return false
+}
+
+func (b *RabbitMqBroker) consume(c *ConsumerChannel) {
+	for {
+		channel, deliveries, closed := c.current()
+		for d := range deliveries {
+			c.handler(channel, &d)
+		}
+		if b.closing() {
+			return
+		}
+		if err, ok := <-closed; ok && err != nil {
+			log.Errorf("rabbitmq consumer %s channel closed: %s", c.id, err)
+		} else {
+			log.Warningf("rabbitmq consumer %s channel closed", c.id)
+		}
+		if !b.recoverConsumerChannel(c) {
+			return
+		}
+	}
+}
+
+func (b *RabbitMqBroker) DeclareExchange(p *ExchangeProperties) error {
+	return b.Channel().ExchangeDeclare(p.Name, p.Kind, p.Durable, p.AutoDelete, false, false, nil)
+}
+
+func (b *RabbitMqBroker) DeclareQueue(id string, p *QueueProperties) (string, error) {
+	q, err := b.WithQueue(id, newRabbitMqQueueProperties(p))
+	if err != nil {
+		return "", err
+	}
+	return q.Name, nil
+}
+
+func (b *RabbitMqBroker) BindQueue(queueName, key, exchange string) error {
+	name, err := b.resolveQueueName(queueName)
+	if err != nil {
+		return err
+	}
+	return b.Channel().QueueBind(name, key, exchange, false, nil)
+}
+
+func (b *RabbitMqBroker) Publish(exchange, key string, m *Message) error {
+	return b.Channel().Publish(exchange, key, false, false, amqp.Publishing{
+		MessageId: m.MessageId,
+		CorrelationId: m.CorrelationId,
+		ReplyTo: m.ReplyTo,
+		ContentType: m.ContentType,
+		Headers: amqp.Table(m.Headers),
+		Timestamp: m.Timestamp,
+		Body: m.Body,
+	})
+}
+
+func (b *RabbitMqBroker) Consume(id string, handler HandlerFunc, p *ConsumerProperties) error {
+	return b.WithConsumer(id, handler, newRabbitMqConsumerProperties(p))
+}
+
+// WithConsumer consumes with a broker handler keeping all the RabbitMQ consumer settings
+func (b *RabbitMqBroker) WithConsumer(id string, handler HandlerFunc, p *RabbitMqConsumerProperties) error {
+	_, err := b.WithConsumerChannel(id, func(channel *amqp.Channel, d *amqp.Delivery) {
+		handler(withLogContext(newRabbitMqDelivery(id, d, p.AutoAck)))
+	}, p)
+	return err
+}
+
+type ConfirmPublisher struct {
+	channel *amqp.Channel
+	confirms chan amqp.Confirmation
+	timeout time.Duration
+	sequence uint64
+	mutex sync.Mutex
+}
+
+// NewConfirmPublisher publishes waiting at most timeout for the broker confirmation of every message
+func (b *RabbitMqBroker) NewConfirmPublisher(timeout time.Duration) (*ConfirmPublisher, error) {
+	if timeout <= 0 {
+		return nil, fmt.Errorf("confirm publisher timeout must be positive, got %s", timeout)
+	}
+	channel, err := b.connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := channel.Confirm(false); err != nil {
+		channel.Close()
+		return nil, fmt.Errorf("failed to put channel in confirm mode, %s", err)
+	}
+	return &ConfirmPublisher{
+		channel: channel,
+		confirms: channel.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		timeout: timeout,
+	}, nil
+}
+
+func (p *ConfirmPublisher) Publish(exchange, key string, m *Message) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	err := p.channel.Publish(exchange, key, false, false, amqp.Publishing{
+		MessageId: m.MessageId,
+		CorrelationId: m.CorrelationId,
+		ReplyTo: m.ReplyTo,
+		ContentType: m.ContentType,
+		Headers: amqp.Table(m.Headers),
+		Timestamp: m.Timestamp,
+		DeliveryMode: amqp.Persistent,
+		Body: m.Body,
+	})
+	if err != nil {
+		return err
+	}
+	p.sequence++
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case confirm, ok := <-p.confirms:
+			if !ok {
+				return fmt.Errorf("confirm channel closed")
+			}
+			if confirm.DeliveryTag < p.sequence {
+				continue
+			}
+			if !confirm.Ack {
+				return fmt.Errorf("message %s not acknowledged by broker", m.MessageId)
+			}
+			return nil
+		case <-timer.C:
+			return fmt.Errorf("timeout waiting for confirmation of message %s", m.MessageId)
+		}
+	}
+}
+
+func (p *ConfirmPublisher) Close() error {
+	return p.channel.Close()
+}
+
+type rabbitMqAcknowledger struct {
+	delivery *amqp.Delivery
+}
+
+func (a *rabbitMqAcknowledger) Ack(tag uint64) error {
+	return a.delivery.Ack(false)
+}
+
+func (a *rabbitMqAcknowledger) Nack(tag uint64, requeue bool) error {
+	return a.delivery.Nack(false, requeue)
+}
+
+// newRabbitMqDelivery leaves auto ack deliveries without acknowledger, RabbitMQ closes the
+// channel on acks of unknown delivery tags
+func newRabbitMqDelivery(consumerId string, d *amqp.Delivery, autoAck bool) *Delivery {
+	delivery := &Delivery{
+		Message: Message{
+			MessageId: d.MessageId,
+			CorrelationId: d.CorrelationId,
+			ReplyTo: d.ReplyTo,
+			ContentType: d.ContentType,
+			Headers: map[string]interface{}(d.Headers),
+			Timestamp: d.Timestamp,
+			Body: d.Body,
+		},
+		ConsumerId: consumerId,
+		Exchange: d.Exchange,
+		RoutingKey: d.RoutingKey,
+		Redelivered: d.Redelivered,
+		tag: d.DeliveryTag,
+	}
+	if !autoAck {
+		delivery.acknowledger = &rabbitMqAcknowledger{delivery: d}
+	}
+	return delivery
+}
+
+func (b *RabbitMqBroker) Close() {
+	b.closeOnce.Do(func() {
+		close(b.done)
+	})
+	for _, c := range b.consumers {
+		if channel, _, _ := c.current(); channel != nil {
+			channel.Close()
+		}
+	}
+	if channel := b.Channel(); channel != nil {
+		channel.Close()
+	}
+	if b.connection != nil {
+		b.connection.Close()
+	}
+}
+
+func (b *RabbitMqBroker) Run() {
+	var wg sync.WaitGroup
+	wg.Add(len(b.consumers))
+	for _, v := range b.consumers {
+		go func(c *ConsumerChannel) {
+			defer wg.Done()
+			b.consume(c)
+		}(v)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRabbitMqQueuePropertiesRoundTrip(t *testing.T) {
+	p := &RabbitMqQueueProperties{
+		Name:           "orders",
+		Durable:        true,
+		Type:           QuorumQueue,
+		MessageTtl:     time.Minute,
+		Expires:        time.Hour,
+		MaxLength:      100,
+		MaxLengthBytes: 1024,
+		Overflow:       OverflowRejectPublish,
+		Args:           map[string]interface{}{"x-delivery-limit": 5},
+	}
+	qp, err := p.QueueProperties()
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted := newRabbitMqQueueProperties(qp)
+	if converted.Type != QuorumQueue || converted.Expires != time.Hour || converted.MaxLengthBytes != 1024 {
+		t.Errorf("expected type, expires and max length bytes read back, got %+v", converted)
+	}
+	expected, err := p.Arguments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, err := converted.Arguments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(args) != fmt.Sprint(expected) {
+		t.Errorf("expected arguments %v, got %v", expected, args)
+	}
+
+	converted.Durable = false
+	if err := converted.Validate(); err == nil {
+		t.Error("expected a converted quorum queue to be validated as quorum")
+	}
+}
+
+func TestRabbitMqPropertiesNotExpressible(t *testing.T) {
+	if _, err := (&RabbitMqQueueProperties{Name: "orders", NoWait: true}).QueueProperties(); err == nil {
+		t.Error("expected queue no_wait to be rejected")
+	}
+	consumers := []*RabbitMqConsumerProperties{
+		{QueueName: "orders", PrefetchSize: 1024},
+		{QueueName: "orders", NoLocal: true},
+		{QueueName: "orders", NoWait: true},
+	}
+	for _, p := range consumers {
+		if _, err := p.ConsumerProperties(); err == nil {
+			t.Errorf("expected consumer %+v to be rejected", p)
+		}
+	}
+	cp, err := (&RabbitMqConsumerProperties{QueueName: "orders", AutoAck: true, PrefetchCount: 10}).ConsumerProperties()
+	if err != nil || cp.QueueName != "orders" || !cp.AutoAck || cp.PrefetchCount != 10 {
+		t.Errorf("unexpected consumer properties %+v, %v", cp, err)
+	}
+}
@@ -0,0 +1,193 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/ivanmtzp/go-microservice/log"
+)
+
+const (
+	directReplyToQueue = "amq.rabbitmq.reply-to"
+
+	RpcErrorCodeHeader    = "x-rpc-error-code"
+	RpcErrorMessageHeader = "x-rpc-error-message"
+
+	RpcErrorInternal = "internal"
+	RpcErrorTimeout  = "timeout"
+)
+
+type RpcError struct {
+	Code    string
+	Message string
+}
+
+func (e *RpcError) Error() string {
+	return fmt.Sprintf("rpc error %s: %s", e.Code, e.Message)
+}
+
+type RpcHandlerFunc func(ctx context.Context, d *Delivery) ([]byte, error)
+
+type RpcClient struct {
+	exchange string
+	timeout  time.Duration
+	channel  *amqp.Channel
+	replies  <-chan amqp.Delivery
+	mutex    sync.Mutex
+	pending  map[string]chan *amqp.Delivery
+	sequence uint64
+}
+
+func (b *RabbitMqBroker) NewRpcClient(exchange string, timeout time.Duration) (*RpcClient, error) {
+	channel, err := b.connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := channel.Consume(directReplyToQueue, "", true, false, false, false, nil)
+	if err != nil {
+		channel.Close()
+		return nil, fmt.Errorf("failed to consume from direct reply-to, %s", err)
+	}
+	c := &RpcClient{
+		exchange: exchange,
+		timeout:  timeout,
+		channel:  channel,
+		replies:  replies,
+		pending:  make(map[string]chan *amqp.Delivery),
+	}
+	go c.dispatch()
+	return c, nil
+}
+
+func (c *RpcClient) dispatch() {
+	for d := range c.replies {
+		reply := d
+		c.mutex.Lock()
+		ch, ok := c.pending[reply.CorrelationId]
+		delete(c.pending, reply.CorrelationId)
+		c.mutex.Unlock()
+		if !ok {
+			log.Warningf("rpc reply with unknown correlation id %s discarded", reply.CorrelationId)
+			continue
+		}
+		ch <- &reply
+	}
+	c.mutex.Lock()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	c.mutex.Unlock()
+}
+
+func (c *RpcClient) Call(ctx context.Context, routingKey string, body []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok && c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	correlationId := strconv.FormatUint(atomic.AddUint64(&c.sequence, 1), 10)
+	replyCh := make(chan *amqp.Delivery, 1)
+
+	publishing := amqp.Publishing{
+		CorrelationId: correlationId,
+		ReplyTo:       directReplyToQueue,
+		Timestamp:     time.Now(),
+		Body:          body,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if ttl := time.Until(deadline) / time.Millisecond; ttl > 0 {
+			publishing.Expiration = strconv.FormatInt(int64(ttl), 10)
+		}
+	}
+
+	c.mutex.Lock()
+	c.pending[correlationId] = replyCh
+	err := c.channel.Publish(c.exchange, routingKey, false, false, publishing)
+	if err != nil {
+		delete(c.pending, correlationId)
+	}
+	c.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply, ok := <-replyCh:
+		if !ok {
+			return nil, fmt.Errorf("rpc client channel closed")
+		}
+		if code, ok := reply.Headers[RpcErrorCodeHeader]; ok {
+			return nil, &RpcError{Code: fmt.Sprint(code), Message: fmt.Sprint(reply.Headers[RpcErrorMessageHeader])}
+		}
+		return reply.Body, nil
+	case <-ctx.Done():
+		c.mutex.Lock()
+		delete(c.pending, correlationId)
+		c.mutex.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (c *RpcClient) Close() error {
+	return c.channel.Close()
+}
+
+func RpcServerHandler(b Broker, timeout time.Duration, handler RpcHandlerFunc) HandlerFunc {
+	return func(d *Delivery) {
+		if d.ReplyTo == "" {
+			log.Warningf("rpc request without reply-to on consumer %s discarded", d.ConsumerId)
+			d.Nack(false)
+			return
+		}
+		ctx := d.Context()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		type result struct {
+			body []byte
+			err  error
+		}
+		results := make(chan result, 1)
+		go func() {
+			body, err := handler(ctx, d)
+			results <- result{body: body, err: err}
+		}()
+
+		reply := &Message{CorrelationId: d.CorrelationId, Timestamp: time.Now()}
+		var err error
+		select {
+		case r := <-results:
+			reply.Body, err = r.body, r.err
+		case <-ctx.Done():
+			err = &RpcError{Code: RpcErrorTimeout, Message: ctx.Err().Error()}
+		}
+		if err != nil {
+			rpcErr, ok := err.(*RpcError)
+			if !ok {
+				rpcErr = &RpcError{Code: RpcErrorInternal, Message: err.Error()}
+			}
+			reply.Body = nil
+			reply.Headers = map[string]interface{}{
+				RpcErrorCodeHeader:    rpcErr.Code,
+				RpcErrorMessageHeader: rpcErr.Message,
+			}
+		}
+		if err := b.Publish("", d.ReplyTo, reply); err != nil {
+			// requeuing would run the request again and likely fail to reply again, the client
+			// times out instead and the request is dead lettered when the queue has an exchange
+			log.Errorf("failed to publish rpc reply for consumer %s, request discarded: %s", d.ConsumerId, err)
+			d.Nack(false)
+			return
+		}
+		d.Ack()
+	}
+}
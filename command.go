@@ -0,0 +1,278 @@
+package microservice
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/ivanmtzp/go-microservice/config"
+	"github.com/ivanmtzp/go-microservice/database"
+)
+
+const (
+	exitOk = 0
+	exitFailure = 1
+	exitUsage = 2
+)
+
+type SetupFunc func(ms *MicroService) error
+
+type CommandRunner struct {
+	name string
+	envPrefix string
+	setup SetupFunc
+	stdout io.Writer
+	stderr io.Writer
+
+	settingsFile string
+	migrationsPath string
+}
+
+func NewCommandRunner(name, envPrefix string, setup SetupFunc) *CommandRunner {
+	return &CommandRunner{name: name, envPrefix: envPrefix, setup: setup, stdout: os.Stdout, stderr: os.Stderr}
+}
+
+func (r *CommandRunner) usage() {
+	fmt.Fprintf(r.stderr, `usage: %s [-config file] [-migrations path] <command> [arguments]
+
+commands:
+  serve                      start the microservice
+  migrate up [-dry-run]      apply pending migrations
+  migrate down [-dry-run] n  roll back the last n migrations
+  migrate to [-dry-run] v    migrate up or down to version v
+  migrate status             list applied and pending migrations
+  db create                  create the database
+  db drop -force             drop the database
+  config print [-sources]    print the settings with secrets redacted
+  config validate            validate the settings
+  healthcheck [-timeout d]   query the running service health status
+`, r.name)
+}
+
+func (r *CommandRunner) Run(args []string) int {
+	flags := flag.NewFlagSet(r.name, flag.ContinueOnError)
+	flags.SetOutput(r.stderr)
+	flags.StringVar(&r.settingsFile, "config", "config.yml", "settings file")
+	flags.StringVar(&r.migrationsPath, "migrations", "migrations", "migrations directory")
+	flags.Usage = r.usage
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		r.usage()
+		return exitUsage
+	}
+	var err error
+	switch args[0] {
+	case "serve":
+		err = r.serve()
+	case "migrate":
+		err = r.migrate(args[1:])
+	case "db":
+		err = r.db(args[1:])
+	case "config":
+		err = r.config(args[1:])
+	case "healthcheck":
+		err = r.healthcheck(args[1:])
+	default:
+		r.usage()
+		return exitUsage
+	}
+	if err == errUsage {
+		r.usage()
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintf(r.stderr, "%s %s: %s\n", r.name, args[0], err)
+		return exitFailure
+	}
+	return exitOk
+}
+
+var errUsage = fmt.Errorf("invalid command usage")
+
+func (r *CommandRunner) microService() (*MicroService, error) {
+	return NewWithSettingsFile(r.name, r.envPrefix, r.settingsFile)
+}
+
+func (r *CommandRunner) serve() error {
+	ms, err := r.microService()
+	if err != nil {
+		return err
+	}
+	if r.setup != nil {
+		if err := r.setup(ms); err != nil {
+			return err
+		}
+	}
+	ms.Run()
+	return nil
+}
+
+func (r *CommandRunner) migrate(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	flags.SetOutput(r.stderr)
+	dryRun := flags.Bool("dry-run", false, "print the migrations without applying them")
+	if err := flags.Parse(args[1:]); err != nil {
+		return errUsage
+	}
+	ms, err := r.microService()
+	if err != nil {
+		return err
+	}
+	var migrations []database.Migration
+	switch args[0] {
+	case "up":
+		migrations, err = ms.MigrateUp(r.migrationsPath, *dryRun)
+	case "down":
+		n := 1
+		if flags.NArg() > 0 {
+			if n, err = strconv.Atoi(flags.Arg(0)); err != nil {
+				return errUsage
+			}
+		}
+		migrations, err = ms.MigrateDown(r.migrationsPath, n, *dryRun)
+	case "to":
+		if flags.NArg() != 1 {
+			return errUsage
+		}
+		migrations, err = ms.MigrateTo(r.migrationsPath, flags.Arg(0), *dryRun)
+	case "status":
+		migrations, err = ms.MigrateStatus(r.migrationsPath)
+	default:
+		return errUsage
+	}
+	for _, m := range migrations {
+		state := "pending"
+		if m.Applied {
+			state = "applied"
+		}
+		fmt.Fprintf(r.stdout, "%s\t%s\t%s\n", m.Version, state, m.Name)
+	}
+	return err
+}
+
+func (r *CommandRunner) db(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	flags := flag.NewFlagSet("db "+args[0], flag.ContinueOnError)
+	flags.SetOutput(r.stderr)
+	force := flags.Bool("force", false, "confirm destructive operations")
+	if err := flags.Parse(args[1:]); err != nil {
+		return errUsage
+	}
+	ms, err := r.microService()
+	if err != nil {
+		return err
+	}
+	s, err := ms.schema(false)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	switch args[0] {
+	case "create":
+		return s.CreateDatabase()
+	case "drop":
+		if !*force {
+			return fmt.Errorf("refusing to drop the database without -force")
+		}
+		return s.DropDatabase()
+	default:
+		return errUsage
+	}
+}
+
+func (r *CommandRunner) config(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	flags := flag.NewFlagSet("config "+args[0], flag.ContinueOnError)
+	flags.SetOutput(r.stderr)
+	sources := flags.Bool("sources", false, "show the file or variable that supplied each setting")
+	if err := flags.Parse(args[1:]); err != nil || flags.NArg() > 0 {
+		return errUsage
+	}
+	switch args[0] {
+	case "print":
+		conf := config.New()
+		if err := conf.Read(r.envPrefix, r.settingsFile); err != nil {
+			return err
+		}
+		if *sources {
+			for _, k := range conf.Keys() {
+				fmt.Fprintf(r.stdout, "%s: %v\t# %s\n", k, conf.Redacted(k), conf.Source(k))
+			}
+			return nil
+		}
+		out, err := yaml.Marshal(conf.RedactedSettings())
+		if err != nil {
+			return err
+		}
+		_, err = r.stdout.Write(out)
+		return err
+	case "validate":
+		if _, err := NewWithValidatedSettingsFile(r.name, r.envPrefix, r.settingsFile); err != nil {
+			return err
+		}
+		fmt.Fprintf(r.stdout, "%s is valid\n", r.settingsFile)
+		return nil
+	default:
+		return errUsage
+	}
+}
+
+func (r *CommandRunner) healthcheck(args []string) error {
+	flags := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	flags.SetOutput(r.stderr)
+	timeout := flags.Duration("timeout", 5*time.Second, "request timeout")
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	ms, err := r.microService()
+	if err != nil {
+		return err
+	}
+	address := ms.settings.Monitoring().Address
+	if host, port, err := net.SplitHostPort(address); err == nil && (host == "" || host == "0.0.0.0" || host == "::") {
+		address = net.JoinHostPort("localhost", port)
+	}
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Get(fmt.Sprintf("http://%s/healthy", address))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var status struct {
+		Healthy bool `json:"healthy"`
+		HealthChecks map[string]string `json:"healthchecks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return fmt.Errorf("invalid health status response, %s", err)
+	}
+	var failed []string
+	for name, result := range status.HealthChecks {
+		fmt.Fprintf(r.stdout, "%s: %s\n", name, result)
+		if result != "ok" {
+			failed = append(failed, name)
+		}
+	}
+	if resp.StatusCode != http.StatusOK || !status.Healthy {
+		return fmt.Errorf("service unhealthy, status %s, failed checks: %s", resp.Status, strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -4,47 +4,304 @@ import (
 	"strings"
 
 	"github.com/spf13/viper"
-	"path/filepath"
 	"fmt"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ivanmtzp/go-microservice/log"
 )
 
-type ConfigFileType string
+const RedactedValue = "******"
 
-const (
-	Yaml	ConfigFileType = "yaml"
-)
+const fileSuffix = "_file"
 
-type Config struct {
+var secretKeys = []string{"password", "secret", "token", "credential", "private_key"}
+
+type ChangeFunc func(old, new interface{})
+
+type subscription struct {
+	key string
+	fn ChangeFunc
+}
+
+type snapshot struct {
 	viper *viper.Viper
+	files []string
+	sources map[string]string
+	secrets map[string]bool
+}
+
+type Config struct {
+	snapshot atomic.Value
+	envPrefix string
+	filename string
+	mutex sync.Mutex
+	watchers []*fileWatcher
+	sources []Source
+	subscriptions []subscription
+	staticKeys []string
 }
 
 func New() *Config {
-	return &Config{viper.New()}
+	c := &Config{}
+	c.snapshot.Store(&snapshot{viper: viper.New(), sources: make(map[string]string), secrets: make(map[string]bool)})
+	return c
+}
+
+func (c *Config) loaded() *snapshot {
+	return c.snapshot.Load().(*snapshot)
+}
+
+func (c *Config) current() *viper.Viper {
+	return c.loaded().viper
 }
 
 func (c *Config) Read(envPrefix, filename string) error {
-	c.viper.SetEnvPrefix(envPrefix)
-	c.viper.AutomaticEnv()
-	replacer := strings.NewReplacer(".", "_")
-	c.viper.SetEnvKeyReplacer(replacer)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	s, err := load(envPrefix, filename, c.sources)
+	if err != nil {
+		return err
+	}
+	c.envPrefix, c.filename = envPrefix, filename
+	c.snapshot.Store(s)
+	return nil
+}
 
-	ext := filepath.Ext(filename)
-	if ext != ".yml" && ext != "yaml"{
-		return fmt.Errorf("configuration error, only yaml config file supported")
+func (c *Config) Watch() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.filename == "" {
+		return fmt.Errorf("configuration error, no configuration file to watch")
+	}
+	if c.watchers != nil {
+		return nil
+	}
+	// every change is loaded into a new snapshot
+	for _, file := range c.loaded().files {
+		file := file
+		watcher, err := watchFile(file, func() {
+			if err := c.Reload(); err != nil {
+				log.Errorf("failed to reload configuration file %s: %s", file, err)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("configuration error, unable to watch %s, %s", file, err)
+		}
+		c.watchers = append(c.watchers, watcher)
+		log.Infof("watching configuration file %s for changes", file)
 	}
-	configDir, configFile := filepath.Split(filename)
-	c.viper.SetConfigType(string(Yaml))
-	c.viper.SetConfigName(strings.Replace(configFile, ext, "", 1))
-	c.viper.AddConfigPath(configDir)
+	for _, source := range c.sources {
+		name := source.Name()
+		err := source.Watch(func() error {
+			err := c.Reload()
+			if err != nil {
+				log.Errorf("failed to reload configuration source %s: %s", name, err)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		log.Infof("watching configuration source %s for changes", name)
+	}
+	return nil
+}
+
+// AddSource merges the values of s over the configuration files, sources added later take
+// precedence. Sources should be added before the settings are used since the built-in
+// sections can't be reloaded.
+func (c *Config) AddSource(s Source) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	sources := append(append([]Source{}, c.sources...), s)
+	if c.filename != "" {
+		loaded, err := load(c.envPrefix, c.filename, sources)
+		if err != nil {
+			return err
+		}
+		c.snapshot.Store(loaded)
+	}
+	c.sources = sources
+	return nil
+}
 
-	if err := c.viper.ReadInConfig(); err != nil {
+func (c *Config) Close() error {
+	c.mutex.Lock()
+	watchers, sources := c.watchers, c.sources
+	c.watchers = nil
+	c.mutex.Unlock()
+	// a watcher may be waiting for the mutex to reload, stop them without holding it
+	for _, w := range watchers {
+		w.Close()
+	}
+	for _, s := range sources {
+		if err := s.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) Reload() error {
+	c.mutex.Lock()
+	s, err := load(c.envPrefix, c.filename, c.sources)
+	if err != nil {
+		c.mutex.Unlock()
 		return err
 	}
+	v := s.viper
+	old := c.current()
+	keys := make(map[string]bool)
+	for _, k := range append(old.AllKeys(), v.AllKeys()...) {
+		keys[k] = true
+	}
+	for k := range keys {
+		if !c.isStatic(k) || reflect.DeepEqual(old.Get(k), v.Get(k)) {
+			continue
+		}
+		log.Warningf("configuration key %s cannot be changed at runtime, keeping current value", k)
+		v.Set(k, old.Get(k))
+		s.sources[k] = c.loaded().sources[k]
+	}
+	c.snapshot.Store(s)
+	subscriptions := append([]subscription{}, c.subscriptions...)
+	c.mutex.Unlock()
+
+	for _, sub := range subscriptions {
+		oldValue, newValue := old.Get(sub.key), v.Get(sub.key)
+		if !reflect.DeepEqual(oldValue, newValue) {
+			sub.fn(oldValue, newValue)
+		}
+	}
+	return nil
+}
+
+func (c *Config) OnChange(key string, fn ChangeFunc) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.subscriptions = append(c.subscriptions, subscription{key: strings.ToLower(key), fn: fn})
+}
+
+func (c *Config) Static(keys ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, k := range keys {
+		c.staticKeys = append(c.staticKeys, strings.ToLower(k))
+	}
+}
+
+func (c *Config) isStatic(key string) bool {
+	for _, k := range c.staticKeys {
+		if key == k || strings.HasPrefix(key, k+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func readSecretFile(filename string) (string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+func resolveFileKeys(v *viper.Viper, sources map[string]string, secrets map[string]bool) error {
+	for _, key := range v.AllKeys() {
+		if !strings.HasSuffix(key, fileSuffix) {
+			continue
+		}
+		filename := v.GetString(key)
+		if filename == "" {
+			continue
+		}
+		value, err := readSecretFile(filename)
+		if err != nil {
+			return fmt.Errorf("configuration error, unable to read %s, %s", key, err)
+		}
+		v.Set(strings.TrimSuffix(key, fileSuffix), value)
+		sources[strings.TrimSuffix(key, fileSuffix)] = "file " + filename
+		secrets[strings.TrimSuffix(key, fileSuffix)] = true
+	}
 	return nil
 }
 
+func (c *Config) AllSettings() map[string]interface{} {
+	return c.current().AllSettings()
+}
+
+func (c *Config) RedactedSettings() map[string]interface{} {
+	return redact(c.current().AllSettings(), "", c.loaded().secrets)
+}
+
+func (c *Config) Redacted(key string) interface{} {
+	key = strings.ToLower(key)
+	i := strings.LastIndex(key, ".")
+	return redact(map[string]interface{}{key[i+1:]: c.current().Get(key)}, key[:i+1], c.loaded().secrets)[key[i+1:]]
+}
+
+func IsSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	if strings.HasSuffix(key, fileSuffix) {
+		return false
+	}
+	for _, s := range secretKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact hides the values of secret keys and of the keys resolved from secret references,
+// path is the prefix of the settings keys
+func redact(settings map[string]interface{}, path string, secrets map[string]bool) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(settings))
+	for k, v := range settings {
+		secret := IsSecretKey(k) || secrets[path+k]
+		switch value := v.(type) {
+		case map[string]interface{}:
+			redacted[k] = redact(value, path+k+".", secrets)
+		case string:
+			if secret && value != "" {
+				redacted[k] = RedactedValue
+			} else {
+				redacted[k] = RedactURL(value)
+			}
+		default:
+			if secret && value != nil {
+				redacted[k] = RedactedValue
+			} else {
+				redacted[k] = value
+			}
+		}
+	}
+	return redacted
+}
+
+func RedactURL(value string) string {
+	if !strings.Contains(value, "://") {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); !ok {
+		return value
+	}
+	u.User = url.UserPassword(u.User.Username(), RedactedValue)
+	return u.String()
+}
+
 func (c* Config) HasKey(keys ...string) (interface{}, bool) {
-	value := c.viper.Get(strings.Join(keys, "."))
+	value := c.current().Get(strings.Join(keys, "."))
 	if value == nil {
 		return nil, false
 	}
@@ -52,19 +309,48 @@ func (c* Config) HasKey(keys ...string) (interface{}, bool) {
 }
 
 func (c *Config) GetString(keys ...string) string {
-	return c.viper.GetString(strings.Join(keys, "."))
+	key := strings.Join(keys, ".")
+	if !c.current().IsSet(key) && c.current().IsSet(key+fileSuffix) {
+		value, err := readSecretFile(c.current().GetString(key + fileSuffix))
+		if err != nil {
+			return ""
+		}
+		return value
+	}
+	return c.resolve(key, c.current().GetString(key))
+}
+
+// resolve replaces the secret references of values that weren't in the configuration files,
+// such as environment variables
+func (c *Config) resolve(key, value string) string {
+	if !isSecretReference(value) {
+		return value
+	}
+	resolved, err := resolveSecretReferences(value)
+	if err != nil {
+		log.Errorf("configuration error, unable to resolve secret for %s: %s", key, err)
+	}
+	return resolved
 }
 
 func (c *Config) GetInt(keys ...string) int {
-	return c.viper.GetInt(strings.Join(keys, "."))
+	return c.current().GetInt(strings.Join(keys, "."))
 }
 
 func (c *Config) GetBool(keys ...string) bool {
-	return c.viper.GetBool(strings.Join(keys, "."))
+	return c.current().GetBool(strings.Join(keys, "."))
+}
+
+func (c *Config) GetDuration(keys ...string) time.Duration {
+	return c.current().GetDuration(strings.Join(keys, "."))
+}
+
+func (c *Config) GetStringSlice(keys ...string) []string {
+	return c.current().GetStringSlice(strings.Join(keys, "."))
 }
 
 func (c *Config) GetStringMap(keys ...string)  map[string]interface{} {
-	return c.viper.GetStringMap(strings.Join(keys, "."))
+	return c.current().GetStringMap(strings.Join(keys, "."))
 }
 
 
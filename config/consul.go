@@ -0,0 +1,173 @@
+package config
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	consulWaitTime      = 5 * time.Minute
+	consulRetryInterval = 5 * time.Second
+)
+
+type consulKeyValue struct {
+	Key   string
+	Value *string
+}
+
+// ConsulSource reads the keys under a prefix from the Consul KV HTTP API, the key
+// <prefix>/database/host provides database.host. Changes are watched with blocking queries.
+type ConsulSource struct {
+	address string
+	prefix  string
+	token   string
+	client  *http.Client
+	retry   time.Duration
+
+	mutex  sync.Mutex
+	index  uint64
+	values map[string]interface{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewConsulSource(address, prefix, token string) *ConsulSource {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ConsulSource{
+		address: strings.TrimSuffix(address, "/"),
+		prefix:  strings.Trim(prefix, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: consulWaitTime + time.Minute},
+		retry:   consulRetryInterval,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (s *ConsulSource) Name() string {
+	return fmt.Sprintf("consul %s/%s", s.address, s.prefix)
+}
+
+func (s *ConsulSource) Load() (map[string]interface{}, error) {
+	values, index, err := s.query(0)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	s.index, s.values = index, values
+	s.mutex.Unlock()
+	return values, nil
+}
+
+func (s *ConsulSource) query(index uint64) (map[string]interface{}, uint64, error) {
+	url := fmt.Sprintf("%s/v1/kv/%s?recurse=true", s.address, s.prefix)
+	if index > 0 {
+		url = fmt.Sprintf("%s&index=%d&wait=%s", url, index, consulWaitTime)
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+	resp, err := s.client.Do(req.WithContext(s.ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if resp.StatusCode == http.StatusNotFound {
+		return map[string]interface{}{}, newIndex, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul kv request failed with status %s", resp.Status)
+	}
+	var kvs []consulKeyValue
+	if err := json.NewDecoder(resp.Body).Decode(&kvs); err != nil {
+		return nil, 0, fmt.Errorf("invalid consul kv response, %s", err)
+	}
+	values := make(map[string]interface{})
+	for _, kv := range kvs {
+		key := strings.Trim(strings.TrimPrefix(kv.Key, s.prefix), "/")
+		if key == "" || kv.Value == nil || strings.HasSuffix(kv.Key, "/") {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(*kv.Value)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid consul kv value for %s, %s", kv.Key, err)
+		}
+		values[strings.Replace(key, "/", ".", -1)] = string(value)
+	}
+	return values, newIndex, nil
+}
+
+// Watch reports a change when the values under the prefix differ from the last ones read. The
+// index of the last response blocks the next query until consul has changes, without an
+// index the keys are polled. The last values are kept until changed succeeds, a failed change
+// is reported again after the retry interval.
+func (s *ConsulSource) Watch(changed func() error) error {
+	go func() {
+		for {
+			s.mutex.Lock()
+			index, last := s.index, s.values
+			s.mutex.Unlock()
+			values, newIndex, err := s.query(index)
+			if err != nil || newIndex == 0 {
+				// back off on errors and on servers that don't support blocking queries
+				if !s.wait() {
+					return
+				}
+				if err != nil {
+					continue
+				}
+			}
+			if s.ctx.Err() != nil {
+				return
+			}
+			// the index may go backwards when consul resets it, start over in that case
+			if newIndex < index {
+				newIndex = 0
+			}
+			if !reflect.DeepEqual(values, last) {
+				if err := changed(); err != nil {
+					// Load may have moved the snapshot forward during the failed change
+					s.mutex.Lock()
+					s.index, s.values = index, last
+					s.mutex.Unlock()
+					if !s.wait() {
+						return
+					}
+					continue
+				}
+			}
+			s.mutex.Lock()
+			s.index, s.values = newIndex, values
+			s.mutex.Unlock()
+		}
+	}()
+	return nil
+}
+
+// wait waits for the retry interval, false when the source is closed
+func (s *ConsulSource) wait() bool {
+	select {
+	case <-s.ctx.Done():
+		return false
+	case <-time.After(s.retry):
+		return true
+	}
+}
+
+func (s *ConsulSource) Close() error {
+	s.cancel()
+	return nil
+}
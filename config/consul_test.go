@@ -0,0 +1,180 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul serves the keys under app from the KV API, blocking queries wait for the next
+// update when the index is known
+type fakeConsul struct {
+	mutex     sync.Mutex
+	index     uint64
+	values    map[string]string
+	sendIndex bool
+	updated   chan struct{}
+	indexes   []string
+}
+
+func newFakeConsul(sendIndex bool, values map[string]string) *fakeConsul {
+	return &fakeConsul{index: 10, values: values, sendIndex: sendIndex, updated: make(chan struct{})}
+}
+
+func (f *fakeConsul) set(key, value string) {
+	f.mutex.Lock()
+	f.index++
+	f.values[key] = value
+	updated := f.updated
+	f.updated = make(chan struct{})
+	f.mutex.Unlock()
+	close(updated)
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/kv/app" || r.URL.Query().Get("recurse") != "true" {
+		http.NotFound(w, r)
+		return
+	}
+	f.mutex.Lock()
+	index := r.URL.Query().Get("index")
+	f.indexes = append(f.indexes, index)
+	updated := f.updated
+	blocking := f.sendIndex && index == fmt.Sprint(f.index)
+	f.mutex.Unlock()
+	if blocking {
+		select {
+		case <-updated:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.sendIndex {
+		w.Header().Set("X-Consul-Index", fmt.Sprint(f.index))
+	}
+	var kvs []map[string]interface{}
+	for k, v := range f.values {
+		kvs = append(kvs, map[string]interface{}{"Key": "app/" + k, "Value": base64.StdEncoding.EncodeToString([]byte(v))})
+	}
+	json.NewEncoder(w).Encode(kvs)
+}
+
+func (f *fakeConsul) requestedIndexes() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.indexes...)
+}
+
+func watchFakeConsul(t *testing.T, fake *fakeConsul) (*ConsulSource, chan struct{}) {
+	changed := make(chan struct{}, 10)
+	s := watchFakeConsulWith(t, fake, func() error {
+		changed <- struct{}{}
+		return nil
+	})
+	return s, changed
+}
+
+func watchFakeConsulWith(t *testing.T, fake *fakeConsul, changed func() error) *ConsulSource {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	s := NewConsulSource(server.URL, "/app/", "")
+	s.retry = 10 * time.Millisecond
+	t.Cleanup(func() { s.Close() })
+
+	values, err := s.Load()
+	if err != nil {
+		t.Fatalf("load failed: %s", err)
+	}
+	if values["database.host"] != "db1" {
+		t.Fatalf("expected database.host db1, got %v", values)
+	}
+	if err := s.Watch(changed); err != nil {
+		t.Fatalf("watch failed: %s", err)
+	}
+	return s
+}
+
+func expectChange(t *testing.T, changed chan struct{}, expected bool) {
+	select {
+	case <-changed:
+		if !expected {
+			t.Fatal("unexpected change reported")
+		}
+	case <-time.After(200 * time.Millisecond):
+		if expected {
+			t.Fatal("change not reported")
+		}
+	}
+}
+
+func TestConsulSourceBlockingIndex(t *testing.T) {
+	fake := newFakeConsul(true, map[string]string{"database/host": "db1"})
+	s, changed := watchFakeConsul(t, fake)
+
+	expectChange(t, changed, false)
+	fake.set("database/host", "db2")
+	expectChange(t, changed, true)
+	values, err := s.Load()
+	if err != nil || values["database.host"] != "db2" {
+		t.Fatalf("expected database.host db2, got %v, %v", values, err)
+	}
+	// the watch blocks on the new index right after reporting the change
+	deadline := time.Now().Add(time.Second)
+	for {
+		requested := make(map[string]bool)
+		for _, index := range fake.requestedIndexes() {
+			requested[index] = true
+		}
+		if requested["10"] && requested["11"] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected blocking queries on indexes 10 and 11, got %v", fake.requestedIndexes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConsulSourceWithoutIndex(t *testing.T) {
+	fake := newFakeConsul(false, map[string]string{"database/host": "db1"})
+	_, changed := watchFakeConsul(t, fake)
+
+	expectChange(t, changed, false)
+	fake.set("database/host", "db2")
+	expectChange(t, changed, true)
+	expectChange(t, changed, false)
+	for _, index := range fake.requestedIndexes() {
+		if index != "" {
+			t.Fatalf("expected polling without index, got index %s", index)
+		}
+	}
+}
+
+func TestConsulSourceRetriesFailedChange(t *testing.T) {
+	fake := newFakeConsul(true, map[string]string{"database/host": "db1"})
+	changed := make(chan struct{}, 10)
+	failures := 1
+	watchFakeConsulWith(t, fake, func() error {
+		changed <- struct{}{}
+		if failures > 0 {
+			failures--
+			return errors.New("reload failed")
+		}
+		return nil
+	})
+
+	fake.set("database/host", "db2")
+	expectChange(t, changed, true)
+	// the failed change is reported again instead of waiting for the next consul change
+	expectChange(t, changed, true)
+	expectChange(t, changed, false)
+}
@@ -0,0 +1,239 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/spf13/cast"
+)
+
+// Decode fills the struct pointed by out with the settings under path, "" being the root.
+// Fields are read from the snake case of their name unless tagged:
+//
+//	Port    int           `config:"port,required"`
+//	Timeout time.Duration `config:"timeout" default:"5s"`
+//	Retry   RetryPolicy   `config:",squash"`
+//	Cache   *Cache        `config:"-"`
+//
+// Nested structs are decoded from the key with their name, pointers to structs only when the
+// key is present, maps of structs once per entry and squashed structs from the parent key.
+// Fields without a value nor a default keep their current value.
+func (c *Config) Decode(path string, out interface{}) error {
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("configuration error, decode target must be a pointer to a struct, got %T", out)
+	}
+	var errs []string
+	c.decodeStruct(strings.ToLower(path), v.Elem(), &errs)
+	if len(errs) > 0 {
+		return fmt.Errorf("configuration error, %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+type fieldTag struct {
+	key        string
+	required   bool
+	squash     bool
+	skip       bool
+	def        string
+	hasDefault bool
+}
+
+func parseTag(f reflect.StructField) fieldTag {
+	t := fieldTag{key: snakeCase(f.Name)}
+	tag := f.Tag.Get("config")
+	if tag == "-" {
+		t.skip = true
+		return t
+	}
+	parts := strings.Split(tag, ",")
+	if parts[0] != "" {
+		t.key = parts[0]
+	}
+	for _, option := range parts[1:] {
+		switch option {
+		case "required":
+			t.required = true
+		case "squash":
+			t.squash = true
+		}
+	}
+	t.def, t.hasDefault = f.Tag.Lookup("default")
+	return t
+}
+
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			previous := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(previous) || unicode.IsDigit(previous) || (unicode.IsUpper(previous) && nextLower) {
+				b.WriteRune('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+func joinKey(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func isStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct || (t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct)
+}
+
+func (c *Config) decodeStruct(path string, v reflect.Value, errs *[]string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := parseTag(f)
+		if tag.skip {
+			continue
+		}
+		if tag.squash && f.Type.Kind() == reflect.Struct {
+			c.decodeStruct(path, v.Field(i), errs)
+			continue
+		}
+		c.decodeValue(joinKey(path, tag.key), tag, v.Field(i), errs)
+	}
+}
+
+func (c *Config) decodeValue(key string, tag fieldTag, v reflect.Value, errs *[]string) {
+	switch {
+	case v.Kind() == reflect.Struct && v.Type() != durationType:
+		c.decodeStruct(key, v, errs)
+		return
+	case v.Kind() == reflect.Ptr && v.Type().Elem().Kind() == reflect.Struct:
+		if _, ok := c.HasKey(key); !ok {
+			if tag.required {
+				*errs = append(*errs, fmt.Sprintf("%s is required", key))
+			}
+			return
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		c.decodeStruct(key, v.Elem(), errs)
+		return
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String && isStruct(v.Type().Elem()):
+		entries := c.GetStringMap(key)
+		if len(entries) == 0 {
+			if tag.required {
+				*errs = append(*errs, fmt.Sprintf("%s is required", key))
+			}
+			return
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for name := range entries {
+			entry := reflect.New(v.Type().Elem()).Elem()
+			c.decodeValue(joinKey(key, name), fieldTag{}, entry, errs)
+			v.SetMapIndex(reflect.ValueOf(name).Convert(v.Type().Key()), entry)
+		}
+		return
+	}
+	raw, ok := c.lookup(key)
+	if !ok {
+		if !tag.hasDefault {
+			if tag.required {
+				*errs = append(*errs, fmt.Sprintf("%s is required", key))
+			}
+			return
+		}
+		raw = tag.def
+	}
+	if err := setValue(v, raw); err != nil {
+		*errs = append(*errs, fmt.Sprintf("%s %s", key, err))
+	}
+}
+
+func (c *Config) lookup(key string) (interface{}, bool) {
+	if value, ok := c.HasKey(key); ok {
+		if s, ok := value.(string); ok {
+			return c.resolve(key, s), true
+		}
+		return value, true
+	}
+	if _, ok := c.HasKey(key + fileSuffix); ok {
+		return c.GetString(key), true
+	}
+	return nil, false
+}
+
+func setValue(v reflect.Value, raw interface{}) error {
+	invalid := func(kind string) error {
+		return fmt.Errorf("must be %s, got %v", kind, raw)
+	}
+	switch {
+	case v.Type() == durationType:
+		d, err := cast.ToDurationE(raw)
+		if err != nil {
+			return invalid("a duration")
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		s, err := cast.ToStringE(raw)
+		if err != nil {
+			return invalid("a string")
+		}
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, err := cast.ToBoolE(raw)
+		if err != nil {
+			return invalid("a boolean")
+		}
+		v.SetBool(b)
+	case v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64:
+		i, err := cast.ToInt64E(raw)
+		if err != nil || v.OverflowInt(i) {
+			return invalid("an integer")
+		}
+		v.SetInt(i)
+	case v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uint64:
+		i, err := cast.ToUint64E(raw)
+		if err != nil || v.OverflowUint(i) {
+			return invalid("a positive integer")
+		}
+		v.SetUint(i)
+	case v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64:
+		f, err := cast.ToFloat64E(raw)
+		if err != nil {
+			return invalid("a number")
+		}
+		v.SetFloat(f)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		s, err := cast.ToStringSliceE(raw)
+		if err != nil {
+			return invalid("a list of strings")
+		}
+		v.Set(reflect.ValueOf(s).Convert(v.Type()))
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String && v.Type().Elem().Kind() == reflect.Interface:
+		m, err := cast.ToStringMapE(raw)
+		if err != nil {
+			return invalid("a map")
+		}
+		v.Set(reflect.ValueOf(m).Convert(v.Type()))
+	case v.Kind() == reflect.Interface:
+		v.Set(reflect.ValueOf(raw))
+	default:
+		return fmt.Errorf("has an unsupported type %s", v.Type())
+	}
+	return nil
+}
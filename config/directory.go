@@ -0,0 +1,120 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultDirectoryPollInterval = 10 * time.Second
+
+// DirectorySource reads one key per file, as in a mounted kubernetes ConfigMap. The file
+// database.host or database/host provides database.host, hidden files are ignored.
+type DirectorySource struct {
+	path     string
+	interval time.Duration
+
+	mutex  sync.Mutex
+	values map[string]interface{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+func NewDirectorySource(path string, interval time.Duration) *DirectorySource {
+	if interval <= 0 {
+		interval = defaultDirectoryPollInterval
+	}
+	return &DirectorySource{path: path, interval: interval, done: make(chan struct{})}
+}
+
+func (s *DirectorySource) Name() string {
+	return fmt.Sprintf("directory %s", s.path)
+}
+
+func (s *DirectorySource) Load() (map[string]interface{}, error) {
+	values, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	s.values = values
+	s.mutex.Unlock()
+	return values, nil
+}
+
+func (s *DirectorySource) read() (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	err := filepath.Walk(s.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != s.path && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.path, path)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		values[strings.Replace(filepath.ToSlash(rel), "/", ".", -1)] = strings.TrimRight(string(content), "\r\n")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Watch polls the directory since mounted volumes are updated by swapping symlinks
+func (s *DirectorySource) Watch(changed func() error) error {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			values, err := s.read()
+			if err != nil {
+				continue
+			}
+			s.mutex.Lock()
+			last := s.values
+			s.mutex.Unlock()
+			if reflect.DeepEqual(values, last) {
+				continue
+			}
+			if err := changed(); err != nil {
+				// a failed reload may have loaded the new values, keep the previous ones so
+				// the change is reported again on the next poll
+				s.mutex.Lock()
+				s.values = last
+				s.mutex.Unlock()
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *DirectorySource) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
@@ -0,0 +1,151 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+type ConfigFileType string
+
+const (
+	Yaml ConfigFileType = "yaml"
+	Json ConfigFileType = "json"
+	Toml ConfigFileType = "toml"
+)
+
+const (
+	EnvironmentEnv = "ENVIRONMENT"
+	localLayer     = "local"
+)
+
+var fileTypes = map[string]ConfigFileType{
+	".yml":  Yaml,
+	".yaml": Yaml,
+	".json": Json,
+	".toml": Toml,
+}
+
+var extensions = []string{".yml", ".yaml", ".json", ".toml"}
+
+func fileType(filename string) (ConfigFileType, error) {
+	t, ok := fileTypes[strings.ToLower(filepath.Ext(filename))]
+	if !ok {
+		return "", fmt.Errorf("configuration error, unsupported config file %s, use one of %s", filename, strings.Join(extensions, ", "))
+	}
+	return t, nil
+}
+
+func envKey(envPrefix, key string) string {
+	key = strings.ToUpper(strings.Replace(key, ".", "_", -1))
+	if envPrefix == "" {
+		return key
+	}
+	return strings.ToUpper(envPrefix) + "_" + key
+}
+
+func Environment(envPrefix string) string {
+	return os.Getenv(envKey(envPrefix, EnvironmentEnv))
+}
+
+// Layers returns the files merged for filename in order: the base file, the overlay for the
+// environment set in <PREFIX>_ENVIRONMENT (config.production.yml) and the local overrides (config.local.yml).
+// Overlays may use any supported format, the base file extension is tried first.
+func Layers(envPrefix, filename string) ([]string, error) {
+	if _, err := fileType(filename); err != nil {
+		return nil, err
+	}
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	var overlays []string
+	if env := Environment(envPrefix); env != "" {
+		overlays = append(overlays, env)
+	}
+	overlays = append(overlays, localLayer)
+	layers := []string{filename}
+	for _, overlay := range overlays {
+		for _, e := range append([]string{ext}, extensions...) {
+			if _, err := os.Stat(base + "." + overlay + e); err == nil {
+				layers = append(layers, base+"."+overlay+e)
+				break
+			}
+		}
+	}
+	return layers, nil
+}
+
+func load(envPrefix, filename string, sources []Source) (*snapshot, error) {
+	layers, err := Layers(envPrefix, filename)
+	if err != nil {
+		return nil, err
+	}
+	v := viper.New()
+	v.SetEnvPrefix(envPrefix)
+	v.AutomaticEnv()
+	replacer := strings.NewReplacer(".", "_")
+	v.SetEnvKeyReplacer(replacer)
+
+	s := &snapshot{viper: v, files: layers, sources: make(map[string]string), secrets: make(map[string]bool)}
+	for _, layer := range layers {
+		t, err := fileType(layer)
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadFile(layer)
+		if err != nil {
+			return nil, err
+		}
+		lv := viper.New()
+		lv.SetConfigType(string(t))
+		if err := lv.ReadConfig(bytes.NewReader(content)); err != nil {
+			return nil, fmt.Errorf("configuration error, unable to parse %s, %s", layer, err)
+		}
+		v.SetConfigType(string(t))
+		if err := v.MergeConfig(bytes.NewReader(content)); err != nil {
+			return nil, fmt.Errorf("configuration error, unable to merge %s, %s", layer, err)
+		}
+		for _, k := range lv.AllKeys() {
+			s.sources[k] = layer
+		}
+	}
+	for _, source := range sources {
+		if err := mergeSource(v, source, s.sources); err != nil {
+			return nil, err
+		}
+	}
+	for _, k := range v.AllKeys() {
+		if _, ok := os.LookupEnv(envKey(envPrefix, k)); ok {
+			s.sources[k] = "env " + envKey(envPrefix, k)
+		}
+	}
+	if err := resolveFileKeys(v, s.sources, s.secrets); err != nil {
+		return nil, err
+	}
+	if err := resolveSecrets(v, s.secrets); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (c *Config) Files() []string {
+	return append([]string{}, c.loaded().files...)
+}
+
+func (c *Config) Keys() []string {
+	keys := c.current().AllKeys()
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *Config) Source(key string) string {
+	if source, ok := c.loaded().sources[strings.ToLower(key)]; ok {
+		return source
+	}
+	return "default"
+}
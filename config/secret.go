@@ -0,0 +1,114 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// Secret holds a sensitive setting, it's redacted when printed or marshalled.
+// Use Value to get the actual secret.
+type Secret string
+
+func (s Secret) Value() string {
+	return string(s)
+}
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return RedactedValue
+}
+
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// SecretProvider resolves the references in ${secret:<provider>:<ref>} setting values
+type SecretProvider interface {
+	Secret(ref string) (string, error)
+}
+
+type SecretProviderFunc func(ref string) (string, error)
+
+func (f SecretProviderFunc) Secret(ref string) (string, error) {
+	return f(ref)
+}
+
+var (
+	secretProvidersMutex sync.RWMutex
+	secretProviders      = map[string]SecretProvider{
+		"file": SecretProviderFunc(readSecretFile),
+		"env": SecretProviderFunc(func(ref string) (string, error) {
+			value, ok := os.LookupEnv(ref)
+			if !ok {
+				return "", fmt.Errorf("environment variable %s not set", ref)
+			}
+			return value, nil
+		}),
+	}
+)
+
+var secretReference = regexp.MustCompile(`\$\{secret:([A-Za-z0-9_-]+):([^}]*)\}`)
+
+func RegisterSecretProvider(name string, p SecretProvider) {
+	secretProvidersMutex.Lock()
+	defer secretProvidersMutex.Unlock()
+	secretProviders[name] = p
+}
+
+func isSecretReference(value string) bool {
+	return strings.Contains(value, "${secret:")
+}
+
+func resolveSecretReferences(value string) (string, error) {
+	var err error
+	resolved := secretReference.ReplaceAllStringFunc(value, func(ref string) string {
+		match := secretReference.FindStringSubmatch(ref)
+		secretProvidersMutex.RLock()
+		provider, ok := secretProviders[match[1]]
+		secretProvidersMutex.RUnlock()
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("unknown secret provider %s", match[1])
+			}
+			return ""
+		}
+		secret, e := provider.Secret(match[2])
+		if e != nil && err == nil {
+			err = fmt.Errorf("secret %s:%s, %s", match[1], match[2], e)
+		}
+		return secret
+	})
+	return resolved, err
+}
+
+func resolveSecrets(v *viper.Viper, secrets map[string]bool) error {
+	var errs []string
+	for _, key := range v.AllKeys() {
+		value, ok := v.Get(key).(string)
+		if !ok || !isSecretReference(value) {
+			continue
+		}
+		resolved, err := resolveSecretReferences(value)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s %s", key, err))
+			continue
+		}
+		v.Set(key, resolved)
+		secrets[key] = true
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("configuration error, unable to resolve secrets: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Source provides configuration values from outside the configuration files.
+// Load returns the values by dotted key, e.g. "database.host".
+// Watch starts watching in the background and calls changed whenever the values change,
+// until the source is closed. When changed fails the change is reported again later.
+type Source interface {
+	Name() string
+	Load() (map[string]interface{}, error)
+	Watch(changed func() error) error
+	Close() error
+}
+
+func nest(values map[string]interface{}) map[string]interface{} {
+	nested := make(map[string]interface{})
+	for key, value := range values {
+		parts := strings.Split(strings.ToLower(key), ".")
+		m := nested
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := m[part].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				m[part] = child
+			}
+			m = child
+		}
+		last := parts[len(parts)-1]
+		if _, ok := m[last].(map[string]interface{}); !ok {
+			m[last] = value
+		}
+	}
+	return nested
+}
+
+func mergeSource(v *viper.Viper, source Source, sources map[string]string) error {
+	values, err := source.Load()
+	if err != nil {
+		return fmt.Errorf("configuration error, unable to load source %s, %s", source.Name(), err)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	content, err := json.Marshal(nest(values))
+	if err != nil {
+		return fmt.Errorf("configuration error, unable to merge source %s, %s", source.Name(), err)
+	}
+	v.SetConfigType(string(Json))
+	if err := v.MergeConfig(bytes.NewReader(content)); err != nil {
+		return fmt.Errorf("configuration error, unable to merge source %s, %s", source.Name(), err)
+	}
+	for key := range values {
+		sources[strings.ToLower(key)] = source.Name()
+	}
+	return nil
+}
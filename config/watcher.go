@@ -0,0 +1,63 @@
+package config
+
+import (
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/ivanmtzp/go-microservice/log"
+)
+
+// fileWatcher calls changed when a configuration file is written. The directory is watched, as
+// viper does, so files replaced by editors or by the symlink swaps of mounted ConfigMaps are
+// noticed too. Unlike the viper watchers it can be stopped.
+type fileWatcher struct {
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+func watchFile(file string, changed func()) (*fileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	file = filepath.Clean(file)
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	w := &fileWatcher{watcher: watcher, done: make(chan struct{})}
+	go w.run(file, changed)
+	return w, nil
+}
+
+func (w *fileWatcher) run(file string, changed func()) {
+	defer close(w.done)
+	realFile, _ := filepath.EvalSymlinks(file)
+	for {
+		select {
+		case e, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			currentFile, _ := filepath.EvalSymlinks(file)
+			written := filepath.Clean(e.Name) == file && e.Op&(fsnotify.Write|fsnotify.Create) != 0
+			if written || (currentFile != "" && currentFile != realFile) {
+				realFile = currentFile
+				changed()
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Warningf("configuration file %s watch error: %s", file, err)
+		}
+	}
+}
+
+// Close stops watching and waits for a reload in progress
+func (w *fileWatcher) Close() error {
+	err := w.watcher.Close()
+	<-w.done
+	return err
+}
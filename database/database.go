@@ -1,9 +1,14 @@
 package database
 
 import (
+	"context"
 	"github.com/gobuffalo/pop"
 	"fmt"
 	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ivanmtzp/go-microservice/config"
 )
 
 type Database struct
@@ -11,27 +16,104 @@ type Database struct
 	properties *Properties
 	connection *pop.Connection
 	healthCheckQuery string
+	replicas []*Replica
+	next uint32
+	done chan struct{}
+	closeOnce sync.Once
+	// mutex orders the start of the replica health checks with Close, which waits for them
+	mutex sync.Mutex
+	healthChecks sync.WaitGroup
 }
 
 type Properties struct {
 	Dialect string
-	Database string
+	Database string `config:"name"`
 	Host string
 	Port int
 	User string
-	Password string
+	Password config.Secret
+	Path string
+	URL config.Secret
 	Pool int
+	// MaxIdle defaults to 2 idle connections, or Pool when it is smaller
+	MaxIdle int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	PoolMetricsInterval time.Duration
+	ConnectRetry RetryPolicy
+	TransactionRetry RetryPolicy
+	Replicas map[string]*Properties `config:"-"`
+	ReplicaFallback bool
+	ReplicaHealthCheckInterval time.Duration
+	Instrumentation QueryInstrumentation `config:",squash"`
+	MigrateOnStart bool
+	MigrationsPath string `default:"migrations"`
+	MigrationLockTimeout time.Duration `config:"migrate_lock_timeout" default:"1m"`
+}
+
+const (
+	SQLiteDialect = "sqlite3"
+	SQLiteMemory = ":memory:"
+	// every connection to a private :memory: database gets a new empty one, so in-memory
+	// databases are opened in the shared cache for schemas and migrations to see the same tables
+	sqliteSharedMemory = "file::memory:"
+)
+
+func (p *Properties) IsSQLite() bool {
+	return p.Dialect == SQLiteDialect || p.Dialect == "sqlite"
+}
+
+func (p *Properties) sqlitePath() string {
+	if p.Path != "" {
+		return p.Path
+	}
+	if p.Database != "" {
+		return p.Database
+	}
+	return SQLiteMemory
+}
+
+func (p *Properties) IsInMemory() bool {
+	return p.IsSQLite() && p.sqlitePath() == SQLiteMemory
+}
+
+func (p *Properties) Address() string {
+	if p.IsSQLite() {
+		return p.sqlitePath()
+	}
+	return fmt.Sprintf("%s:%d", p.Host, p.Port)
 }
 
 func (d *Database) Address() string {
-	return fmt.Sprintf("%s:%d", d.properties.Host, d.properties.Port)
+	return d.properties.Address()
+}
+
+func (d *Database) Dialect() string {
+	return d.properties.Dialect
 }
 
 func (d *Database) Connection() (*pop.Connection){
 	return d.connection
 }
 
+func (d *Database) Schema() *Schema {
+	return &Schema{properties: d.properties, connection: d.connection, shared: true}
+}
+
+func (d *Database) MigrateWithLock() error {
+	return d.WithLock("migrations", d.properties.MigrationLockTimeout, func() error {
+		return d.Schema().MigrateDatabase(d.properties.MigrationsPath)
+	})
+}
+
 func (d *Database) Close() error {
+	d.mutex.Lock()
+	d.closeOnce.Do(func() {
+		close(d.done)
+	})
+	d.mutex.Unlock()
+	d.healthChecks.Wait()
+	d.closeReplicas()
 	if d.connection != nil {
 		return d.connection.Close()
 	}
@@ -39,15 +121,47 @@ func (d *Database) Close() error {
 }
 
 func createConnection(p *Properties) (*pop.Connection, error) {
+	if p.URL != "" {
+		if err := p.ApplyURL(p.URL.Value()); err != nil {
+			return nil, err
+		}
+	}
 	cd := &pop.ConnectionDetails{
 		Dialect: p.Dialect,
 		Database: p.Database,
 		Host: p.Host,
 		Port: strconv.Itoa(p.Port),
 		User: p.User,
-		Password: p.Password,
+		Password: p.Password.Value(),
 		Pool: p.Pool,
-		IdlePool: 0,
+		IdlePool: p.maxIdle(),
+	}
+	if p.URL != "" && !p.IsSQLite() {
+		cd = &pop.ConnectionDetails{
+			URL: p.URL.Value(),
+			Pool: p.Pool,
+			IdlePool: p.maxIdle(),
+		}
+	}
+	if p.IsSQLite() {
+		cd = &pop.ConnectionDetails{
+			Dialect: SQLiteDialect,
+			Database: p.Address(),
+			Pool: p.Pool,
+			IdlePool: p.maxIdle(),
+		}
+		if p.IsInMemory() {
+			cd.Database = sqliteSharedMemory
+			cd.Options = map[string]string{"cache": "shared"}
+			cd.Pool, cd.IdlePool = 1, 1
+		}
+	}
+	if p.Instrumentation.Enabled {
+		driverName, err := instrumentedDriver(p.Dialect, p.Instrumentation)
+		if err != nil {
+			return nil, fmt.Errorf("failed to instrument the database connection %s", err)
+		}
+		cd.Driver = driverName
 	}
 	connection, err := pop.NewConnection(cd)
 	if err != nil {
@@ -56,6 +170,7 @@ func createConnection(p *Properties) (*pop.Connection, error) {
 	if err := connection.Open(); err != nil {
 		return nil, fmt.Errorf("failed to open database connection %s", err)
 	}
+	configurePool(connection, p)
 	return connection, nil
 }
 
@@ -65,16 +180,34 @@ func (d *Database) HealthCheck() error {
 }
 
 func NewDatabase(p *Properties, healthCheckQuery string) (*Database, error) {
-	connection, err := createConnection(p)
+	return NewDatabaseContext(context.Background(), p, healthCheckQuery)
+}
+
+func NewDatabaseContext(ctx context.Context, p *Properties, healthCheckQuery string) (*Database, error) {
+	var db *Database
+	err := retry(ctx, p.ConnectRetry, fmt.Sprintf("database connection to %s", p.Address()), func() error {
+		connection, err := createConnection(p)
+		if err != nil {
+			return err
+		}
+		d := &Database{
+			properties: p,
+			connection: connection,
+			healthCheckQuery: healthCheckQuery,
+			done: make(chan struct{})}
+		if err := d.HealthCheck(); err != nil {
+			connection.Close()
+			return fmt.Errorf("failed database healthcheck %s", err)
+		}
+		db = d
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	db := &Database{
-		properties: p,
-		connection: connection,
-		healthCheckQuery: healthCheckQuery}
-	if err := db.HealthCheck(); err != nil {
-		return nil, fmt.Errorf("failed database healthcheck %s", err)
+	if err := db.openReplicas(); err != nil {
+		db.Close()
+		return nil, err
 	}
 	return db, nil
 }
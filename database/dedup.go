@@ -0,0 +1,100 @@
+package database
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gobuffalo/pop"
+)
+
+const (
+	deduplicationMigrationVersion = "20181002000000"
+	deduplicationMigrationName    = "create_processed_messages"
+
+	deduplicationMigrationUp = `create_table("processed_messages") {
+	t.Column("id", "string", {"primary": true})
+	t.Column("processed_at", "timestamp", {})
+	t.DisableTimestamps()
+}
+add_index("processed_messages", "processed_at", {})
+`
+	deduplicationMigrationDown = `drop_table("processed_messages")
+`
+)
+
+type DeduplicationStore struct {
+	database    *Database
+	ttl         time.Duration
+	mutex       sync.Mutex
+	lastCleanup time.Time
+}
+
+type processedMessages struct {
+	Count int `db:"count"`
+}
+
+func NewDeduplicationStore(db *Database, ttl time.Duration) *DeduplicationStore {
+	return &DeduplicationStore{database: db, ttl: ttl, lastCleanup: time.Now()}
+}
+
+func WriteDeduplicationMigrations(migrationsPath string) error {
+	files := map[string]string{
+		fmt.Sprintf("%s_%s.up.fizz", deduplicationMigrationVersion, deduplicationMigrationName):   deduplicationMigrationUp,
+		fmt.Sprintf("%s_%s.down.fizz", deduplicationMigrationVersion, deduplicationMigrationName): deduplicationMigrationDown,
+	}
+	for name, content := range files {
+		filename := filepath.Join(migrationsPath, name)
+		if _, err := os.Stat(filename); err == nil {
+			continue
+		}
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed to write deduplication migration %s, %s", filename, err)
+		}
+	}
+	return nil
+}
+
+func (s *DeduplicationStore) Contains(key string) (bool, error) {
+	query := "SELECT COUNT(*) AS count FROM processed_messages WHERE id = ?"
+	args := []interface{}{key}
+	if s.ttl > 0 {
+		query += " AND processed_at > ?"
+		args = append(args, time.Now().Add(-s.ttl))
+	}
+	var result processedMessages
+	if err := s.database.Connection().RawQuery(query, args...).First(&result); err != nil {
+		return false, err
+	}
+	return result.Count > 0, nil
+}
+
+func (s *DeduplicationStore) Add(key string) error {
+	err := s.database.Connection().Transaction(func(tx *pop.Connection) error {
+		if err := tx.RawQuery("DELETE FROM processed_messages WHERE id = ?", key).Exec(); err != nil {
+			return err
+		}
+		return tx.RawQuery("INSERT INTO processed_messages (id, processed_at) VALUES (?, ?)", key, time.Now()).Exec()
+	})
+	if err != nil {
+		return err
+	}
+	return s.cleanup()
+}
+
+func (s *DeduplicationStore) cleanup() error {
+	if s.ttl <= 0 {
+		return nil
+	}
+	s.mutex.Lock()
+	if time.Since(s.lastCleanup) < s.ttl {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.lastCleanup = time.Now()
+	s.mutex.Unlock()
+	return s.database.Connection().RawQuery("DELETE FROM processed_messages WHERE processed_at < ?", time.Now().Add(-s.ttl)).Exec()
+}
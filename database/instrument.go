@@ -0,0 +1,259 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ivanmtzp/go-microservice/log"
+	"github.com/ivanmtzp/go-microservice/monitoring"
+)
+
+// QueryInstrumentation times the queries and logs the ones slower than SlowQueryThreshold.
+// Bind parameters may hold personal data or secrets, they are only logged with LogParams.
+type QueryInstrumentation struct {
+	Enabled            bool `config:"instrument_queries"`
+	SlowQueryThreshold time.Duration
+	LogParams          bool `config:"slow_query_log_params"`
+}
+
+var (
+	instrumentedDriversMutex sync.Mutex
+	instrumentedDrivers      = make(map[instrumentedDriverKey]string)
+)
+
+type instrumentedDriverKey struct {
+	driver          string
+	instrumentation QueryInstrumentation
+}
+
+func sqlDriverName(dialect string) string {
+	switch dialect {
+	case "postgres", "cockroach":
+		return "postgres"
+	case "sqlite", "sqlite3":
+		return "sqlite3"
+	default:
+		return dialect
+	}
+}
+
+func instrumentedDriver(dialect string, qi QueryInstrumentation) (string, error) {
+	key := instrumentedDriverKey{driver: sqlDriverName(dialect), instrumentation: qi}
+	instrumentedDriversMutex.Lock()
+	defer instrumentedDriversMutex.Unlock()
+	if name, ok := instrumentedDrivers[key]; ok {
+		return name, nil
+	}
+	db, err := sql.Open(key.driver, "")
+	if err != nil {
+		return "", fmt.Errorf("sql driver %s not registered, %s", key.driver, err)
+	}
+	d := db.Driver()
+	db.Close()
+	name := fmt.Sprintf("instrumented_%s_%d", key.driver, len(instrumentedDrivers))
+	sql.Register(name, &instrumentingDriver{driver: d, instrumentation: qi})
+	instrumentedDrivers[key] = name
+	return name, nil
+}
+
+func operation(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "other"
+	}
+	switch op := strings.ToLower(fields[0]); op {
+	case "select", "insert", "update", "delete", "with", "create", "drop", "alter":
+		return op
+	default:
+		return "other"
+	}
+}
+
+func (qi QueryInstrumentation) observe(query string, args []driver.NamedValue, start time.Time) {
+	elapsed := time.Since(start)
+	monitoring.UpdateTimerSince(fmt.Sprintf("database.query.%s", operation(query)), start, time.Millisecond)
+	if qi.SlowQueryThreshold <= 0 || elapsed < qi.SlowQueryThreshold {
+		return
+	}
+	monitoring.IncCounter("database.query.slow", 1)
+	if !qi.LogParams || len(args) == 0 {
+		log.Warningf("slow query (%s): %s", elapsed, query)
+		return
+	}
+	values := make([]interface{}, len(args))
+	for i, a := range args {
+		values[i] = a.Value
+	}
+	log.Warningf("slow query (%s): %s %v", elapsed, query, values)
+}
+
+type instrumentingDriver struct {
+	driver          driver.Driver
+	instrumentation QueryInstrumentation
+}
+
+func (d *instrumentingDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{Conn: conn, instrumentation: d.instrumentation}, nil
+}
+
+type instrumentedConn struct {
+	driver.Conn
+	instrumentation QueryInstrumentation
+}
+
+func (c *instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{Stmt: stmt, query: query, instrumentation: c.instrumentation}, nil
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{Stmt: stmt, query: query, instrumentation: c.instrumentation}, nil
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) || opts.ReadOnly {
+		return nil, fmt.Errorf("sql driver does not support transaction isolation levels nor read only transactions")
+	}
+	return c.Conn.Begin()
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := e.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.instrumentation.observe(query, args, start)
+	}
+	return result, err
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.instrumentation.observe(query, args, start)
+	}
+	return rows, err
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type instrumentedStmt struct {
+	driver.Stmt
+	query           string
+	instrumentation QueryInstrumentation
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+func (s *instrumentedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	start := time.Now()
+	result, err := s.Stmt.Exec(args)
+	s.instrumentation.observe(s.query, namedValues(args), start)
+	return result, err
+}
+
+func (s *instrumentedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.Stmt.Query(args)
+	s.instrumentation.observe(s.query, namedValues(args), start)
+	return rows, err
+}
+
+func (s *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	var result driver.Result
+	var err error
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = e.ExecContext(ctx, args)
+	} else {
+		values := make([]driver.Value, len(args))
+		for i, a := range args {
+			values[i] = a.Value
+		}
+		result, err = s.Stmt.Exec(values)
+	}
+	s.instrumentation.observe(s.query, args, start)
+	return result, err
+}
+
+func (s *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = q.QueryContext(ctx, args)
+	} else {
+		values := make([]driver.Value, len(args))
+		for i, a := range args {
+			values[i] = a.Value
+		}
+		rows, err = s.Stmt.Query(values)
+	}
+	s.instrumentation.observe(s.query, args, start)
+	return rows, err
+}
+
+func (s *instrumentedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
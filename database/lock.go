@@ -0,0 +1,144 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/ivanmtzp/go-microservice/log"
+)
+
+const lockRetryInterval = 500 * time.Millisecond
+
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+type connPool interface {
+	Conn(ctx context.Context) (*sql.Conn, error)
+}
+
+type lockFunc func(ctx context.Context, conn *sql.Conn) (unlock func() error, err error)
+
+// WithLock runs fn holding a lock shared by every instance using the database. The lock is held
+// on a connection of the pool, which needs room for another one to run fn. SQLite databases
+// belong to a single process and run fn without lock.
+func (d *Database) WithLock(name string, timeout time.Duration, fn func() error) error {
+	dialect := d.connection.Dialect.Name()
+	var lock lockFunc
+	switch dialect {
+	case "postgres":
+		lock = postgresLock(lockKey(name))
+	case "mysql":
+		lock = mysqlLock(name)
+	case "cockroach":
+		lock = tableLock(name)
+	case SQLiteDialect:
+		return fn()
+	default:
+		return fmt.Errorf("database dialect %s does not support locks, %s not run", dialect, name)
+	}
+	if d.properties.Pool == 1 {
+		return fmt.Errorf("database lock %s needs a pool of at least 2 connections", name)
+	}
+	pool, ok := d.connection.Store.(connPool)
+	if !ok {
+		return fmt.Errorf("database store %T does not provide connections for lock %s", d.connection.Store, name)
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := pool.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	log.Infof("acquiring database lock %s", name)
+	unlock, err := lock(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("failed to acquire database lock %s, %s", name, err)
+	}
+	defer func() {
+		if err := unlock(); err != nil {
+			log.Errorf("failed to release database lock %s: %s", name, err)
+		}
+	}()
+	log.Infof("database lock %s acquired", name)
+	return fn()
+}
+
+func postgresLock(key int64) lockFunc {
+	return func(ctx context.Context, conn *sql.Conn) (func() error, error) {
+		for {
+			var locked bool
+			if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked); err != nil {
+				return nil, err
+			}
+			if locked {
+				return func() error {
+					_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+					return err
+				}, nil
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(lockRetryInterval):
+			}
+		}
+	}
+}
+
+func mysqlLock(name string) lockFunc {
+	return func(ctx context.Context, conn *sql.Conn) (func() error, error) {
+		timeout := -1
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = int(time.Until(deadline) / time.Second)
+		}
+		var locked sql.NullInt64
+		if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, timeout).Scan(&locked); err != nil {
+			return nil, err
+		}
+		if !locked.Valid || locked.Int64 != 1 {
+			return nil, fmt.Errorf("timeout waiting for lock")
+		}
+		return func() error {
+			_, err := conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", name)
+			return err
+		}, nil
+	}
+}
+
+const lockTable = "database_locks"
+
+// tableLock locks a row of the locks table for dialects without advisory locks. The row stays
+// locked by an open transaction, so it is released even when the connection is lost.
+func tableLock(name string) lockFunc {
+	return func(ctx context.Context, conn *sql.Conn) (func() error, error) {
+		if _, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+lockTable+" (name STRING PRIMARY KEY)"); err != nil {
+			return nil, err
+		}
+		if _, err := conn.ExecContext(ctx, "INSERT INTO "+lockTable+" (name) VALUES ($1) ON CONFLICT DO NOTHING", name); err != nil {
+			return nil, err
+		}
+		// the transaction outlives the lock timeout, only waiting for the row is bounded by ctx
+		tx, err := conn.BeginTx(context.Background(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, "SELECT name FROM "+lockTable+" WHERE name = $1 FOR UPDATE", name); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		return tx.Rollback, nil
+	}
+}
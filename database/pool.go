@@ -0,0 +1,129 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/gobuffalo/pop"
+
+	"github.com/ivanmtzp/go-microservice/log"
+	"github.com/ivanmtzp/go-microservice/monitoring"
+)
+
+type sqlPool interface {
+	SetMaxOpenConns(n int)
+	SetMaxIdleConns(n int)
+	SetConnMaxLifetime(d time.Duration)
+	SetConnMaxIdleTime(d time.Duration)
+	Stats() sql.DBStats
+}
+
+const defaultMaxIdle = 2
+
+// maxIdle defaults to database/sql's own default of 2 idle connections, capped by the pool size
+func (p *Properties) maxIdle() int {
+	if p.MaxIdle > 0 {
+		return p.MaxIdle
+	}
+	if p.Pool > 0 && p.Pool < defaultMaxIdle {
+		return p.Pool
+	}
+	return defaultMaxIdle
+}
+
+func configurePool(connection *pop.Connection, p *Properties) {
+	pool, ok := connection.Store.(sqlPool)
+	if !ok {
+		log.Warningf("database connection pool settings not supported for dialect %s", p.Dialect)
+		return
+	}
+	if p.IsInMemory() {
+		pool.SetMaxOpenConns(1)
+		pool.SetMaxIdleConns(1)
+		return
+	}
+	if p.Pool > 0 {
+		pool.SetMaxOpenConns(p.Pool)
+	}
+	pool.SetMaxIdleConns(p.maxIdle())
+	if p.ConnMaxLifetime > 0 {
+		pool.SetConnMaxLifetime(p.ConnMaxLifetime)
+	}
+	if p.ConnMaxIdleTime > 0 {
+		pool.SetConnMaxIdleTime(p.ConnMaxIdleTime)
+	}
+}
+
+func (d *Database) PoolStats() (sql.DBStats, bool) {
+	pool, ok := d.connection.Store.(sqlPool)
+	if !ok {
+		return sql.DBStats{}, false
+	}
+	return pool.Stats(), true
+}
+
+// HealthDetail reports the pool statistics and the state of the replicas, an unhealthy replica
+// is excluded from reads without failing the database health check
+func (d *Database) HealthDetail() map[string]interface{} {
+	detail := make(map[string]interface{})
+	if stats, ok := d.PoolStats(); ok {
+		detail["max_open"] = stats.MaxOpenConnections
+		detail["open"] = stats.OpenConnections
+		detail["in_use"] = stats.InUse
+		detail["idle"] = stats.Idle
+		detail["wait_count"] = stats.WaitCount
+		detail["wait_duration"] = stats.WaitDuration.String()
+		detail["max_idle_closed"] = stats.MaxIdleClosed
+		detail["max_lifetime_closed"] = stats.MaxLifetimeClosed
+	}
+	if len(d.replicas) > 0 {
+		replicas := make(map[string]interface{}, len(d.replicas))
+		for _, r := range d.replicas {
+			replicas[r.Name()] = map[string]interface{}{
+				"address": r.Address(),
+				"healthy": r.Healthy(),
+			}
+		}
+		detail["replicas"] = replicas
+	}
+	if len(detail) == 0 {
+		return nil
+	}
+	return detail
+}
+
+func (d *Database) updatePoolMetrics() {
+	stats, ok := d.PoolStats()
+	if !ok {
+		return
+	}
+	name := func(metric string) string {
+		return fmt.Sprintf("database.pool.%s", metric)
+	}
+	monitoring.UpdateGauge(name("open"), int64(stats.OpenConnections))
+	monitoring.UpdateGauge(name("in_use"), int64(stats.InUse))
+	monitoring.UpdateGauge(name("idle"), int64(stats.Idle))
+	monitoring.UpdateGauge(name("wait_count"), stats.WaitCount)
+	monitoring.UpdateGauge(name("wait_duration_ms"), int64(stats.WaitDuration/time.Millisecond))
+	monitoring.UpdateGauge(name("max_idle_closed"), stats.MaxIdleClosed)
+	monitoring.UpdateGauge(name("max_lifetime_closed"), stats.MaxLifetimeClosed)
+}
+
+func (d *Database) RunPoolMetrics() {
+	interval := d.properties.PoolMetricsInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	d.updatePoolMetrics()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			d.updatePoolMetrics()
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobuffalo/pop"
+
+	"github.com/ivanmtzp/go-microservice/log"
+)
+
+type Replica struct {
+	name             string
+	properties       *Properties
+	connection       *pop.Connection
+	healthCheckQuery string
+	healthy          int32
+}
+
+func newReplica(name string, p *Properties, healthCheckQuery string) (*Replica, error) {
+	connection, err := createConnection(p)
+	if err != nil {
+		return nil, fmt.Errorf("replica %s, %s", name, err)
+	}
+	r := &Replica{name: name, properties: p, connection: connection, healthCheckQuery: healthCheckQuery}
+	if err := r.HealthCheck(); err != nil {
+		log.Warningf("database replica %s unhealthy on start: %s", name, err)
+	}
+	return r, nil
+}
+
+func (r *Replica) Name() string {
+	return r.name
+}
+
+func (r *Replica) Address() string {
+	return r.properties.Address()
+}
+
+func (r *Replica) Connection() *pop.Connection {
+	return r.connection
+}
+
+func (r *Replica) Healthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+func (r *Replica) HealthCheck() error {
+	var response []interface{}
+	err := r.connection.RawQuery(r.healthCheckQuery).All(&response)
+	if err != nil {
+		if atomic.SwapInt32(&r.healthy, 0) == 1 {
+			log.Warningf("database replica %s excluded, health check failed: %s", r.name, err)
+		}
+		return err
+	}
+	if atomic.SwapInt32(&r.healthy, 1) == 0 {
+		log.Infof("database replica %s healthy", r.name)
+	}
+	return nil
+}
+
+func (d *Database) openReplicas() error {
+	names := make([]string, 0, len(d.properties.Replicas))
+	for name := range d.properties.Replicas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r, err := newReplica(name, d.properties.Replicas[name], d.healthCheckQuery)
+		if err != nil {
+			return err
+		}
+		d.replicas = append(d.replicas, r)
+	}
+	return nil
+}
+
+// closeReplicas keeps the replicas slice, Replica may still be reading it
+func (d *Database) closeReplicas() {
+	for _, r := range d.replicas {
+		r.connection.Close()
+	}
+}
+
+func (d *Database) Primary() *pop.Connection {
+	return d.connection
+}
+
+func (d *Database) Replicas() []*Replica {
+	return d.replicas
+}
+
+func (d *Database) Replica() (*pop.Connection, error) {
+	if len(d.replicas) == 0 {
+		return d.connection, nil
+	}
+	n := uint32(len(d.replicas))
+	start := atomic.AddUint32(&d.next, 1)
+	for i := uint32(0); i < n; i++ {
+		r := d.replicas[(start+i)%n]
+		if r.Healthy() {
+			return r.connection, nil
+		}
+	}
+	if d.properties.ReplicaFallback {
+		return d.connection, nil
+	}
+	return nil, fmt.Errorf("no healthy database replica available")
+}
+
+func (d *Database) RunReplicaHealthChecks() {
+	if len(d.replicas) == 0 || !d.startHealthChecks() {
+		return
+	}
+	defer d.healthChecks.Done()
+	interval := d.properties.ReplicaHealthCheckInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			for _, r := range d.replicas {
+				r.HealthCheck()
+			}
+		}
+	}
+}
+
+// startHealthChecks registers a health check loop unless the database is closed
+func (d *Database) startHealthChecks() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	select {
+	case <-d.done:
+		return false
+	default:
+	}
+	d.healthChecks.Add(1)
+	return true
+}
@@ -0,0 +1,152 @@
+//go:build sqlite
+// +build sqlite
+
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gobuffalo/pop"
+)
+
+func sqliteProperties(t *testing.T, name string) *Properties {
+	return &Properties{Dialect: SQLiteDialect, Path: filepath.Join(t.TempDir(), name+".db")}
+}
+
+func newReplicatedDatabase(t *testing.T, fallback bool) *Database {
+	p := sqliteProperties(t, "primary")
+	p.ReplicaFallback = fallback
+	p.Replicas = map[string]*Properties{
+		"a": sqliteProperties(t, "a"),
+		"b": sqliteProperties(t, "b"),
+	}
+	d, err := NewDatabase(p, "SELECT 1")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	if len(d.Replicas()) != 2 {
+		t.Fatalf("expected 2 replicas, got %d", len(d.Replicas()))
+	}
+	return d
+}
+
+func replicaName(t *testing.T, d *Database) string {
+	connection, err := d.Replica()
+	if err != nil {
+		t.Fatalf("no replica: %s", err)
+	}
+	return connectionName(d, connection)
+}
+
+func connectionName(d *Database, connection *pop.Connection) string {
+	if connection == d.Primary() {
+		return "primary"
+	}
+	for _, r := range d.Replicas() {
+		if connection == r.Connection() {
+			return r.Name()
+		}
+	}
+	return "unknown"
+}
+
+// setHealthy makes the health check of the replica fail or succeed and runs it
+func setHealthy(d *Database, name string, healthy bool) {
+	for _, r := range d.Replicas() {
+		if r.Name() != name {
+			continue
+		}
+		r.healthCheckQuery = "SELECT 1"
+		if !healthy {
+			r.healthCheckQuery = "SELECT * FROM missing_table"
+		}
+		r.HealthCheck()
+	}
+}
+
+func TestReplicaRoundRobin(t *testing.T) {
+	d := newReplicatedDatabase(t, false)
+	for _, r := range d.Replicas() {
+		if !r.Healthy() {
+			t.Fatalf("expected replica %s healthy on start", r.Name())
+		}
+	}
+
+	first := replicaName(t, d)
+	for i := 0; i < 4; i++ {
+		next := replicaName(t, d)
+		if next == first || next == "primary" {
+			t.Fatalf("expected reads to alternate between the replicas, got %s after %s", next, first)
+		}
+		first = next
+	}
+}
+
+func TestReplicaExclusion(t *testing.T) {
+	d := newReplicatedDatabase(t, false)
+
+	setHealthy(d, "a", false)
+	for i := 0; i < 4; i++ {
+		if name := replicaName(t, d); name != "b" {
+			t.Fatalf("expected unhealthy replica a excluded, got %s", name)
+		}
+	}
+
+	setHealthy(d, "b", false)
+	if _, err := d.Replica(); err == nil {
+		t.Error("expected an error without healthy replicas and fallback")
+	}
+
+	setHealthy(d, "a", true)
+	if name := replicaName(t, d); name != "a" {
+		t.Errorf("expected replica a included again once healthy, got %s", name)
+	}
+}
+
+func TestReplicaFallback(t *testing.T) {
+	d := newReplicatedDatabase(t, true)
+	setHealthy(d, "a", false)
+	setHealthy(d, "b", false)
+
+	if name := replicaName(t, d); name != "primary" {
+		t.Errorf("expected reads to fall back to the primary, got %s", name)
+	}
+	detail := d.HealthDetail()["replicas"].(map[string]interface{})
+	if a := detail["a"].(map[string]interface{}); a["healthy"] != false {
+		t.Errorf("expected replica a reported unhealthy, got %v", a)
+	}
+}
+
+func TestReplicaCloseStopsHealthChecks(t *testing.T) {
+	d := newReplicatedDatabase(t, true)
+	d.properties.ReplicaHealthCheckInterval = time.Millisecond
+	stopped := make(chan struct{})
+	go func() {
+		d.RunReplicaHealthChecks()
+		close(stopped)
+	}()
+	reads := make(chan struct{})
+	go func() {
+		defer close(reads)
+		for i := 0; i < 100; i++ {
+			d.Replica()
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-reads
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("replica health checks still running after close")
+	}
+	if len(d.Replicas()) != 2 {
+		t.Errorf("expected the replicas kept after close, got %d", len(d.Replicas()))
+	}
+}
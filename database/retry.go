@@ -0,0 +1,57 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ivanmtzp/go-microservice/log"
+)
+
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Deadline       time.Duration
+}
+
+func (r RetryPolicy) enabled() bool {
+	return r.MaxAttempts > 1 || r.Deadline > 0
+}
+
+func retry(ctx context.Context, policy RetryPolicy, name string, fn func() error) error {
+	if !policy.enabled() {
+		return fn()
+	}
+	if policy.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Deadline)
+		defer cancel()
+	}
+	backoff := policy.InitialBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 1 {
+				log.Infof("%s succeeded on attempt %d", name, attempt)
+			}
+			return nil
+		}
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			return fmt.Errorf("%s failed after %d attempts, %s", name, attempt, err)
+		}
+		log.Warningf("%s attempt %d failed, retrying in %s: %s", name, attempt, backoff, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s aborted after %d attempts, %s: %s", name, attempt, ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
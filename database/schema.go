@@ -1,17 +1,55 @@
 package database
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
 	"github.com/gobuffalo/pop"
+
+	"github.com/ivanmtzp/go-microservice/log"
 )
 
+const AllowRecreateEnv = "ALLOW_DATABASE_RECREATE"
 
 type Schema struct {
 	properties *Properties
 	connection *pop.Connection
+	dryRun bool
+	// shared schemas use the connection of a Database, which keeps it open on Close
+	shared bool
+}
+
+type Migration struct {
+	Version string
+	Name string
+	Applied bool
+}
+
+type schemaMigration struct {
+	Version string `db:"version"`
+}
+
+type sqliteTable struct {
+	Name string `db:"name"`
 }
 
 func NewSchema(p *Properties) (*Schema, error) {
-	connection, err := createConnection(p)
+	return NewSchemaContext(context.Background(), p)
+}
+
+func NewSchemaContext(ctx context.Context, p *Properties) (*Schema, error) {
+	var connection *pop.Connection
+	err := retry(ctx, p.ConnectRetry, fmt.Sprintf("database connection to %s", p.Address()), func() error {
+		c, err := createConnection(p)
+		if err != nil {
+			return err
+		}
+		connection = c
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -23,27 +61,244 @@ func NewSchema(p *Properties) (*Schema, error) {
 	return schema, nil
 }
 
+func (s *Schema) SetDryRun(dryRun bool) {
+	s.dryRun = dryRun
+}
+
+func (s *Schema) DryRun() bool {
+	return s.dryRun
+}
+
+func (s *Schema) Close() error {
+	if s.connection != nil && !s.shared {
+		return s.connection.Close()
+	}
+	return nil
+}
+
 func (s *Schema) CreateDatabase() error {
+	if s.dryRun {
+		log.Infof("dry run: create database %s", s.name())
+		return nil
+	}
+	if s.properties.IsInMemory() {
+		return nil
+	}
 	return pop.CreateDB(s.connection)
 }
 
 func (s *Schema) DropDatabase() error {
+	if s.dryRun {
+		log.Infof("dry run: drop database %s", s.name())
+		return nil
+	}
+	if s.properties.IsInMemory() {
+		return s.dropTables()
+	}
 	return pop.DropDB(s.connection)
 }
 
+func (s *Schema) name() string {
+	if s.properties.IsSQLite() {
+		return s.properties.Address()
+	}
+	return s.properties.Database
+}
+
+// dropTables empties an in-memory database, it lives as long as any connection to it is open
+func (s *Schema) dropTables() error {
+	var tables []sqliteTable
+	if err := s.connection.RawQuery("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'").All(&tables); err != nil {
+		return err
+	}
+	for _, t := range tables {
+		if err := s.connection.RawQuery(fmt.Sprintf("DROP TABLE %q", t.Name)).Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Schema) reconnect() error {
+	if s.shared || s.properties.IsInMemory() {
+		return nil
+	}
+	if s.connection != nil {
+		s.connection.Close()
+	}
+	connection, err := createConnection(s.properties)
+	if err != nil {
+		return err
+	}
+	s.connection = connection
+	return nil
+}
+
 func (s* Schema) MigrateDatabase(migrationsPath string) error {
+	_, err := s.MigrateUp(migrationsPath)
+	return err
+}
+
+func (s *Schema) migrator(migrationsPath string) (pop.FileMigrator, map[string]bool, error) {
 	mig, err := pop.NewFileMigrator(migrationsPath, s.connection)
 	if err != nil {
-		return err
+		return mig, nil, err
+	}
+	if err := mig.CreateSchemaMigrations(); err != nil {
+		return mig, nil, err
+	}
+	var rows []schemaMigration
+	query := fmt.Sprintf("SELECT version FROM %s", s.connection.MigrationTableName())
+	if err := s.connection.RawQuery(query).All(&rows); err != nil {
+		return mig, nil, err
+	}
+	applied := make(map[string]bool)
+	for _, r := range rows {
+		applied[r.Version] = true
+	}
+	return mig, applied, nil
+}
+
+// versionNumber compares migration versions as numbers, version 9 comes before 10
+func versionNumber(version string) uint64 {
+	n, _ := strconv.ParseUint(version, 10, 64)
+	return n
+}
+
+func sortedMigrations(migrations pop.Migrations) pop.Migrations {
+	sorted := append(pop.Migrations{}, migrations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return versionNumber(sorted[i].Version) < versionNumber(sorted[j].Version)
+	})
+	return sorted
+}
+
+func (s *Schema) MigrateStatus(migrationsPath string) ([]Migration, error) {
+	mig, applied, err := s.migrator(migrationsPath)
+	if err != nil {
+		return nil, err
+	}
+	var status []Migration
+	for _, m := range sortedMigrations(mig.Migrations["up"]) {
+		status = append(status, Migration{Version: m.Version, Name: m.Name, Applied: applied[m.Version]})
+	}
+	return status, nil
+}
+
+func (s *Schema) MigrateUp(migrationsPath string) ([]Migration, error) {
+	return s.migrateUpTo(migrationsPath, "")
+}
+
+func (s *Schema) MigrateDown(migrationsPath string, n int) ([]Migration, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid number of migrations to roll back %d", n)
+	}
+	mig, applied, err := s.migrator(migrationsPath)
+	if err != nil {
+		return nil, err
 	}
-	return mig.Up()
+	down := sortedMigrations(mig.Migrations["down"])
+	var rollback pop.Migrations
+	for i := len(down) - 1; i >= 0 && len(rollback) < n; i-- {
+		if applied[down[i].Version] {
+			rollback = append(rollback, down[i])
+		}
+	}
+	return s.run(rollback, false)
+}
+
+// MigrateTo rolls back the applied migrations above version and applies the pending ones up to it
+func (s *Schema) MigrateTo(migrationsPath, version string) ([]Migration, error) {
+	target, err := strconv.ParseUint(version, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid migration version %s", version)
+	}
+	mig, applied, err := s.migrator(migrationsPath)
+	if err != nil {
+		return nil, err
+	}
+	known := false
+	for _, m := range mig.Migrations["up"] {
+		if versionNumber(m.Version) == target {
+			known = true
+		}
+	}
+	if !known {
+		return nil, fmt.Errorf("migration version %s not found in %s", version, migrationsPath)
+	}
+	down := sortedMigrations(mig.Migrations["down"])
+	var rollback pop.Migrations
+	for i := len(down) - 1; i >= 0; i-- {
+		if versionNumber(down[i].Version) > target && applied[down[i].Version] {
+			rollback = append(rollback, down[i])
+		}
+	}
+	done, err := s.run(rollback, false)
+	if err != nil {
+		return done, err
+	}
+	up, err := s.migrateUpTo(migrationsPath, version)
+	return append(done, up...), err
+}
+
+func (s *Schema) migrateUpTo(migrationsPath, version string) ([]Migration, error) {
+	mig, applied, err := s.migrator(migrationsPath)
+	if err != nil {
+		return nil, err
+	}
+	var pending pop.Migrations
+	for _, m := range sortedMigrations(mig.Migrations["up"]) {
+		if version != "" && versionNumber(m.Version) > versionNumber(version) {
+			break
+		}
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	return s.run(pending, true)
+}
+
+func (s *Schema) run(migrations pop.Migrations, up bool) ([]Migration, error) {
+	table := s.connection.MigrationTableName()
+	var done []Migration
+	for _, m := range migrations {
+		if s.dryRun {
+			log.Infof("dry run: migrate %s %s_%s", m.Direction, m.Version, m.Name)
+			done = append(done, Migration{Version: m.Version, Name: m.Name, Applied: !up})
+			continue
+		}
+		err := s.connection.Transaction(func(tx *pop.Connection) error {
+			if err := m.Run(tx); err != nil {
+				return err
+			}
+			if up {
+				return tx.RawQuery(fmt.Sprintf("INSERT INTO %s (version) VALUES (?)", table), m.Version).Exec()
+			}
+			return tx.RawQuery(fmt.Sprintf("DELETE FROM %s WHERE version = ?", table), m.Version).Exec()
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %s %s_%s failed, %s", m.Direction, m.Version, m.Name, err)
+		}
+		log.Infof("migrated %s %s_%s", m.Direction, m.Version, m.Name)
+		done = append(done, Migration{Version: m.Version, Name: m.Name, Applied: up})
+	}
+	return done, nil
 }
 
 func (s *Schema) RecreateDatabase(migrationsPath string) error {
-	s.DropDatabase()
+	if os.Getenv(AllowRecreateEnv) != "true" {
+		return fmt.Errorf("refusing to recreate database %s, set %s=true to allow it", s.name(), AllowRecreateEnv)
+	}
+	if err := s.DropDatabase(); err != nil {
+		log.Warningf("failed to drop database %s: %s", s.name(), err)
+	}
 	if err := s.CreateDatabase(); err != nil {
 		return err
 	}
+	if !s.dryRun {
+		if err := s.reconnect(); err != nil {
+			return err
+		}
+	}
 	return s.MigrateDatabase(migrationsPath)
 }
-
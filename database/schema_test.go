@@ -0,0 +1,184 @@
+//go:build sqlite
+// +build sqlite
+
+package database
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/gobuffalo/pop"
+)
+
+type widget struct {
+	Name string `db:"name"`
+}
+
+func writeMigration(t *testing.T, path, version, table string) {
+	files := map[string]string{
+		fmt.Sprintf("%s_create_%s.up.sql", version, table):   fmt.Sprintf("CREATE TABLE %s (name TEXT NOT NULL);", table),
+		fmt.Sprintf("%s_create_%s.down.sql", version, table): fmt.Sprintf("DROP TABLE %s;", table),
+	}
+	for name, sql := range files {
+		if err := ioutil.WriteFile(filepath.Join(path, name), []byte(sql), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func writeMigrations(t *testing.T) string {
+	path := t.TempDir()
+	writeMigration(t, path, "20200101000000", "widgets")
+	writeMigration(t, path, "20200102000000", "gadgets")
+	return path
+}
+
+func newTestSchema(t *testing.T, p *Properties) *Schema {
+	s, err := NewSchema(p)
+	if err != nil {
+		t.Fatalf("failed to open schema: %s", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func insertWidget(t *testing.T, connection *pop.Connection, name string) {
+	if err := connection.RawQuery("INSERT INTO widgets (name) VALUES (?)", name).Exec(); err != nil {
+		t.Fatalf("insert failed: %s", err)
+	}
+}
+
+func widgets(t *testing.T, connection *pop.Connection) []widget {
+	var rows []widget
+	if err := connection.RawQuery("SELECT name FROM widgets").All(&rows); err != nil {
+		t.Fatalf("select failed: %s", err)
+	}
+	return rows
+}
+
+func TestSchemaMigrateUp(t *testing.T) {
+	migrations := writeMigrations(t)
+	s := newTestSchema(t, sqliteProperties(t, "schema"))
+
+	applied, err := s.MigrateUp(migrations)
+	if err != nil {
+		t.Fatalf("migrate up failed: %s", err)
+	}
+	if len(applied) != 2 || applied[0].Version != "20200101000000" || applied[1].Version != "20200102000000" {
+		t.Fatalf("expected both migrations applied in order, got %v", applied)
+	}
+	status, err := s.MigrateStatus(migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range status {
+		if !m.Applied {
+			t.Errorf("expected migration %s_%s applied", m.Version, m.Name)
+		}
+	}
+	if applied, err := s.MigrateUp(migrations); err != nil || len(applied) != 0 {
+		t.Errorf("expected nothing left to migrate, got %v, %v", applied, err)
+	}
+	insertWidget(t, s.connection, "bolt")
+	if rows := widgets(t, s.connection); len(rows) != 1 {
+		t.Errorf("expected 1 widget, got %v", rows)
+	}
+}
+
+func TestSchemaRecreateDatabase(t *testing.T) {
+	migrations := writeMigrations(t)
+	s := newTestSchema(t, sqliteProperties(t, "schema"))
+	if _, err := s.MigrateUp(migrations); err != nil {
+		t.Fatalf("migrate up failed: %s", err)
+	}
+	insertWidget(t, s.connection, "bolt")
+
+	t.Setenv(AllowRecreateEnv, "")
+	if err := s.RecreateDatabase(migrations); err == nil {
+		t.Fatalf("expected recreate to be refused without %s", AllowRecreateEnv)
+	}
+	if rows := widgets(t, s.connection); len(rows) != 1 {
+		t.Fatalf("expected the refused recreate to keep the data, got %v", rows)
+	}
+
+	t.Setenv(AllowRecreateEnv, "true")
+	if err := s.RecreateDatabase(migrations); err != nil {
+		t.Fatalf("recreate failed: %s", err)
+	}
+	if rows := widgets(t, s.connection); len(rows) != 0 {
+		t.Errorf("expected an empty database after recreate, got %v", rows)
+	}
+	status, err := s.MigrateStatus(migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 2 || !status[0].Applied || !status[1].Applied {
+		t.Errorf("expected the migrations applied again, got %v", status)
+	}
+}
+
+func TestSchemaInMemoryShared(t *testing.T) {
+	migrations := writeMigrations(t)
+	d, err := NewDatabase(&Properties{Dialect: SQLiteDialect, Path: SQLiteMemory}, "SELECT 1")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	s := d.Schema()
+	if _, err := s.MigrateUp(migrations); err != nil {
+		t.Fatalf("migrate up failed: %s", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	insertWidget(t, d.Connection(), "bolt")
+	if rows := widgets(t, d.Connection()); len(rows) != 1 {
+		t.Fatalf("expected the database to see the migrated table, got %v", rows)
+	}
+
+	t.Setenv(AllowRecreateEnv, "true")
+	if err := d.Schema().RecreateDatabase(migrations); err != nil {
+		t.Fatalf("recreate failed: %s", err)
+	}
+	if rows := widgets(t, d.Connection()); len(rows) != 0 {
+		t.Errorf("expected an empty database after recreate, got %v", rows)
+	}
+	if err := d.HealthCheck(); err != nil {
+		t.Errorf("expected the database connection open after closing its schema, %s", err)
+	}
+}
+
+func TestSchemaMigrateToRollsBackAndApplies(t *testing.T) {
+	migrations := t.TempDir()
+	writeMigration(t, migrations, "1", "widgets")
+	writeMigration(t, migrations, "10", "gizmos")
+	s := newTestSchema(t, sqliteProperties(t, "schema"))
+	if _, err := s.MigrateUp(migrations); err != nil {
+		t.Fatalf("migrate up failed: %s", err)
+	}
+	// a migration merged below the applied ones, 9 sorts before 10
+	writeMigration(t, migrations, "9", "gadgets")
+
+	done, err := s.MigrateTo(migrations, "9")
+	if err != nil {
+		t.Fatalf("migrate to failed: %s", err)
+	}
+	if len(done) != 2 || done[0].Version != "10" || done[0].Applied || done[1].Version != "9" || !done[1].Applied {
+		t.Errorf("expected 10 rolled back and 9 applied, got %v", done)
+	}
+	status, err := s.MigrateStatus(migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Migration{
+		{Version: "1", Name: "create_widgets", Applied: true},
+		{Version: "9", Name: "create_gadgets", Applied: true},
+		{Version: "10", Name: "create_gizmos", Applied: false},
+	}
+	if fmt.Sprint(status) != fmt.Sprint(expected) {
+		t.Errorf("expected status %v, got %v", expected, status)
+	}
+}
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/pop"
+	"github.com/jmoiron/sqlx"
+
+	"github.com/ivanmtzp/go-microservice/log"
+	"github.com/ivanmtzp/go-microservice/monitoring"
+)
+
+const defaultTransactionAttempts = 3
+
+var retryableSqlStates = []string{"40001", "40P01"}
+
+var retryableErrorMessages = []string{
+	"could not serialize access",
+	"deadlock detected",
+	"Error 1213",
+	"Error 1205",
+	"restart transaction",
+}
+
+type txBeginner interface {
+	BeginTxx(ctx context.Context, opts *sql.TxOptions) (*sqlx.Tx, error)
+}
+
+type sqlStater interface {
+	SQLState() string
+}
+
+func isRetryableTransactionError(err error) bool {
+	for err != nil {
+		if s, ok := err.(sqlStater); ok {
+			for _, state := range retryableSqlStates {
+				if s.SQLState() == state {
+					return true
+				}
+			}
+		}
+		msg := err.Error()
+		for _, m := range retryableErrorMessages {
+			if strings.Contains(msg, m) {
+				return true
+			}
+		}
+		switch e := err.(type) {
+		case interface{ Cause() error }:
+			err = e.Cause()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			err = nil
+		}
+	}
+	return false
+}
+
+func (d *Database) WithTransaction(ctx context.Context, isolation sql.IsolationLevel, fn func(tx *pop.Connection) error) error {
+	policy := d.properties.TransactionRetry
+	attempts := policy.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultTransactionAttempts
+	}
+	backoff := policy.InitialBackoff
+	if backoff <= 0 {
+		backoff = 10 * time.Millisecond
+	}
+	for attempt := 1; ; attempt++ {
+		err := d.transaction(ctx, isolation, fn)
+		if err == nil {
+			return nil
+		}
+		if !isRetryableTransactionError(err) || attempt >= attempts {
+			monitoring.IncCounter("database.transaction.failures", 1)
+			return err
+		}
+		monitoring.IncCounter("database.transaction.retries", 1)
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)))
+		log.Debugf("transaction attempt %d failed, retrying in %s: %s", attempt, wait, err)
+		select {
+		case <-ctx.Done():
+			monitoring.IncCounter("database.transaction.failures", 1)
+			return fmt.Errorf("transaction aborted, %s: %s", ctx.Err(), err)
+		case <-time.After(wait):
+		}
+		backoff *= 2
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+func (d *Database) transaction(ctx context.Context, isolation sql.IsolationLevel, fn func(tx *pop.Connection) error) (err error) {
+	beginner, ok := d.connection.Store.(txBeginner)
+	if !ok {
+		return fmt.Errorf("database connection does not support transactions with options")
+	}
+	sqlxTx, err := beginner.BeginTxx(ctx, &sql.TxOptions{Isolation: isolation})
+	if err != nil {
+		return err
+	}
+	tx := &pop.Tx{ID: rand.Int(), Tx: sqlxTx}
+	cn := *d.connection
+	cn.ID = fmt.Sprintf("%s-tx-%d", d.connection.ID, tx.ID)
+	cn.Store = tx
+	cn.TX = tx
+
+	defer func() {
+		if p := recover(); p != nil {
+			sqlxTx.Rollback()
+			panic(p)
+		}
+	}()
+	if err := fn(&cn); err != nil {
+		if rollbackErr := sqlxTx.Rollback(); rollbackErr != nil {
+			log.Errorf("transaction rollback failed: %s", rollbackErr)
+		}
+		return err
+	}
+	return sqlxTx.Commit()
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ivanmtzp/go-microservice/config"
+)
+
+var urlSchemeDialects = map[string]string{
+	"postgres":    "postgres",
+	"postgresql":  "postgres",
+	"cockroach":   "cockroach",
+	"cockroachdb": "cockroach",
+	"mysql":       "mysql",
+	"sqlite":      SQLiteDialect,
+	"sqlite3":     SQLiteDialect,
+}
+
+func (p *Properties) ApplyURL(dsn string) error {
+	i := strings.Index(dsn, "://")
+	if i < 0 {
+		return fmt.Errorf("invalid database url, missing scheme")
+	}
+	dialect, ok := urlSchemeDialects[strings.ToLower(dsn[:i])]
+	if !ok {
+		return fmt.Errorf("invalid database url, unsupported scheme %s", dsn[:i])
+	}
+	p.Dialect = dialect
+	p.URL = config.Secret(dsn)
+	if p.IsSQLite() {
+		p.Path = strings.SplitN(dsn[i+3:], "?", 2)[0]
+		return nil
+	}
+	// mysql urls may wrap the address in parentheses, e.g. mysql://user:pass@(host:3306)/db
+	u, err := url.Parse(strings.NewReplacer("@(", "@", ")/", "/").Replace(dsn))
+	if err != nil {
+		return fmt.Errorf("invalid database url, %s", err)
+	}
+	p.Host = u.Hostname()
+	if port := u.Port(); port != "" {
+		if p.Port, err = strconv.Atoi(port); err != nil {
+			return fmt.Errorf("invalid database url port %s", port)
+		}
+	}
+	if u.User != nil {
+		p.User = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			p.Password = config.Secret(password)
+		}
+	}
+	p.Database = strings.TrimPrefix(u.Path, "/")
+	return nil
+}
@@ -0,0 +1,86 @@
+package grpc
+
+import (
+	"net/http"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/ivanmtzp/go-microservice/log"
+)
+
+func firstMetadataValue(md metadata.MD, key string) string {
+	if values := md[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func traceId(traceparent, traceIdHeader string) string {
+	if id := log.TraceId(traceparent); id != "" {
+		return id
+	}
+	return traceIdHeader
+}
+
+func logContext(ctx context.Context, method string) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	requestId := firstMetadataValue(md, log.RequestIdHeader)
+	if requestId == "" {
+		requestId = log.NewRequestId()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(log.RequestIdHeader, requestId))
+	fields := log.Fields{
+		log.RequestIdField: requestId,
+		log.MethodField:    method,
+		log.TraceIdField:   traceId(firstMetadataValue(md, log.TraceparentHeader), firstMetadataValue(md, log.TraceIdHeader)),
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		fields[log.PeerField] = p.Addr.String()
+	}
+	return log.NewContext(ctx, fields)
+}
+
+func unaryLogInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(logContext(ctx, info.FullMethod), req)
+}
+
+type logServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *logServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func streamLogInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &logServerStream{ServerStream: ss, ctx: logContext(ss.Context(), info.FullMethod)})
+}
+
+// logHandler sets the correlation fields of gateway requests and forwards the request and
+// trace ids to the gRPC server as metadata, so both sides log the same ids
+func logHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(log.RequestIdHeader)
+		if requestId == "" {
+			requestId = log.NewRequestId()
+		}
+		w.Header().Set(log.RequestIdHeader, requestId)
+		r.Header.Set("Grpc-Metadata-"+log.RequestIdHeader, requestId)
+		if traceparent := r.Header.Get(log.TraceparentHeader); traceparent != "" {
+			r.Header.Set("Grpc-Metadata-"+log.TraceparentHeader, traceparent)
+		}
+		if id := r.Header.Get(log.TraceIdHeader); id != "" {
+			r.Header.Set("Grpc-Metadata-"+log.TraceIdHeader, id)
+		}
+		ctx := log.NewContext(r.Context(), log.Fields{
+			log.RequestIdField: requestId,
+			log.PeerField:      r.RemoteAddr,
+			log.TraceIdField:   traceId(r.Header.Get(log.TraceparentHeader), r.Header.Get(log.TraceIdHeader)),
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
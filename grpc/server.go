@@ -32,7 +32,7 @@ type HttpGatewayServer struct {
 
 
 func NewServer(address string, sr ServerServiceRegistrationFunc) *Server {
-	grpcServer := grpc.NewServer()
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(unaryLogInterceptor), grpc.StreamInterceptor(streamLogInterceptor))
 	sr(grpcServer)
 	return &Server{grpcServer: grpcServer, address: address}
 }
@@ -66,6 +66,10 @@ func (s *Server) Run() error {
 	return nil
 }
 
+func (s *Server) Stop() {
+	s.grpcServer.GracefulStop()
+}
+
 func (s* HttpGatewayServer) Address() string {
 	return s.address
 }
@@ -94,7 +98,7 @@ func (s *HttpGatewayServer) HealthCheck() error {
 func (s *HttpGatewayServer) Run() error {
 	defer s.cancel()
 
-	if err := http.ListenAndServe(s.address, s.mux); err != nil {
+	if err := http.ListenAndServe(s.address, logHandler(s.mux)); err != nil {
 		return fmt.Errorf("http grpc gateway server failed to listen and serve: %s", err)
 	}
 
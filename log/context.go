@@ -0,0 +1,99 @@
+package log
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	RequestIdField = "request_id"
+	MethodField    = "grpc_method"
+	PeerField      = "peer"
+	ConsumerField  = "consumer"
+	TraceIdField   = "trace_id"
+)
+
+const (
+	RequestIdHeader   = "x-request-id"
+	TraceIdHeader     = "x-trace-id"
+	TraceparentHeader = "traceparent"
+)
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying fields, added to the fields already in ctx
+func NewContext(ctx context.Context, fields Fields) context.Context {
+	merged := ContextFields(ctx)
+	for k, v := range fields {
+		if v != nil && v != "" {
+			merged[k] = v
+		}
+	}
+	return context.WithValue(ctx, contextKey{}, merged)
+}
+
+func ContextFields(ctx context.Context) Fields {
+	fields := make(Fields)
+	if ctx == nil {
+		return fields
+	}
+	if f, ok := ctx.Value(contextKey{}).(Fields); ok {
+		for k, v := range f {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// FromContext returns a logger with the correlation fields carried by ctx
+func FromContext(ctx context.Context) *Logger {
+	return &Logger{entry: log.NewEntry(log.StandardLogger()).WithFields(log.Fields(ContextFields(ctx)))}
+}
+
+func NewRequestId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// TraceId returns the trace id of a W3C traceparent header, version-traceid-parentid-flags,
+// empty when it is not 32 lowercase hex digits or all zeros
+func TraceId(traceparent string) string {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || !validTraceId(parts[1]) {
+		return ""
+	}
+	return parts[1]
+}
+
+func validTraceId(id string) bool {
+	if len(id) != 32 || strings.Trim(id, "0") == "" {
+		return false
+	}
+	for _, r := range id {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Traceparent returns a W3C traceparent header continuing the trace of ctx with a new parent id,
+// empty when ctx has no valid trace id
+func Traceparent(ctx context.Context) string {
+	traceId, _ := ContextFields(ctx)[TraceIdField].(string)
+	if !validTraceId(traceId) {
+		return ""
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return "00-" + traceId + "-" + hex.EncodeToString(b) + "-00"
+}
@@ -1,16 +1,35 @@
 package log
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 
+var (
+	hostname string
+	pid = os.Getpid()
+	// formatterMutex guards appName and format, set when the settings are reloaded
+	formatterMutex sync.Mutex
+	appName string
+	format = TextFormat
+)
+
+const (
+	TextFormat = "text"
+	JsonFormat = "json"
+)
+
 func init() {
+	hostname, _ = os.Hostname()
 	log.SetLevel(log.InfoLevel)
 	log.SetFormatter(&defaultFormatter{})
 }
@@ -20,9 +39,8 @@ type defaultFormatter struct {
 }
 
 func (l *defaultFormatter) Format(entry *log.Entry) ([]byte, error) {
-	timestamp := time.Now().Format(time.RFC3339)
-	hostname, _ := os.Hostname()
-	return []byte(fmt.Sprintf("%s %s [%d]: %s %s\n", timestamp, hostname, os.Getpid(), strings.ToUpper(entry.Level.String()), entry.Message)), nil
+	timestamp := entry.Time.Format(time.RFC3339)
+	return []byte(fmt.Sprintf("%s %s [%d]: %s %s%s\n", timestamp, hostname, pid, strings.ToUpper(entry.Level.String()), entry.Message, formatFields(entry.Data))), nil
 }
 
 type appFormatter struct {
@@ -30,13 +48,109 @@ type appFormatter struct {
 }
 
 func (l *appFormatter) Format(entry *log.Entry) ([]byte, error) {
-	timestamp := time.Now().Format(time.RFC3339)
-	hostname, _ := os.Hostname()
-	return []byte(fmt.Sprintf("%s %s %s[%d]: %s %s\n", timestamp, hostname, l.appName, os.Getpid(), strings.ToUpper(entry.Level.String()), entry.Message)), nil
+	timestamp := entry.Time.Format(time.RFC3339)
+	return []byte(fmt.Sprintf("%s %s %s[%d]: %s %s%s\n", timestamp, hostname, l.appName, pid, strings.ToUpper(entry.Level.String()), entry.Message, formatFields(entry.Data))), nil
+}
+
+func formatFields(fields log.Fields) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		value := fieldValue(fields[k])
+		if s, ok := value.(string); ok && (s == "" || strings.ContainsAny(s, " \t\n\"=")) {
+			value = strconv.Quote(s)
+		}
+		fmt.Fprintf(&b, " %s=%v", k, value)
+	}
+	return b.String()
+}
+
+func fieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+type jsonFormatter struct {
+	appName string
+}
+
+var reservedJsonKeys = map[string]bool{"time": true, "level": true, "msg": true, "host": true, "pid": true, "app": true}
+
+// Format writes the entry as a JSON object, fields named as the entry keys are written as
+// fields.<name> so they don't overwrite them
+func (l *jsonFormatter) Format(entry *log.Entry) ([]byte, error) {
+	data := make(map[string]interface{}, len(entry.Data)+6)
+	for k, v := range entry.Data {
+		if reservedJsonKeys[k] {
+			k = "fields." + k
+		}
+		data[k] = fieldValue(v)
+	}
+	data["time"] = entry.Time.Format(time.RFC3339Nano)
+	data["level"] = entry.Level.String()
+	data["msg"] = entry.Message
+	data["host"] = hostname
+	data["pid"] = pid
+	if l.appName != "" {
+		data["app"] = l.appName
+	}
+	out, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal log entry, %s", err)
+	}
+	return append(out, '\n'), nil
+}
+
+func setFormatter() {
+	switch {
+	case format == JsonFormat:
+		log.SetFormatter(&jsonFormatter{appName: appName})
+	case appName != "":
+		log.SetFormatter(&appFormatter{appName: appName})
+	default:
+		log.SetFormatter(&defaultFormatter{})
+	}
+}
+
+func SetAppFormatter(name string){
+	formatterMutex.Lock()
+	defer formatterMutex.Unlock()
+	appName = name
+	setFormatter()
+}
+
+func SetFormat(f string) error {
+	formatterMutex.Lock()
+	defer formatterMutex.Unlock()
+	switch f {
+	case "", TextFormat:
+		format = TextFormat
+	case JsonFormat:
+		format = JsonFormat
+	default:
+		return fmt.Errorf("unknown log format %s", f)
+	}
+	setFormatter()
+	return nil
 }
 
-func SetAppFormatter(appName string){
-	log.SetFormatter(&appFormatter{appName: appName})
+func Format() string {
+	formatterMutex.Lock()
+	defer formatterMutex.Unlock()
+	return format
 }
 
 func Level() string {
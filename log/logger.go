@@ -0,0 +1,100 @@
+package log
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+type Fields map[string]interface{}
+
+// Logger logs with a set of fields attached to every entry
+type Logger struct {
+	entry *log.Entry
+}
+
+func WithField(key string, value interface{}) *Logger {
+	return &Logger{entry: log.WithField(key, value)}
+}
+
+func WithFields(fields Fields) *Logger {
+	return &Logger{entry: log.WithFields(log.Fields(fields))}
+}
+
+func WithError(err error) *Logger {
+	return &Logger{entry: log.WithError(err)}
+}
+
+func (l *Logger) WithField(key string, value interface{}) *Logger {
+	return &Logger{entry: l.entry.WithField(key, value)}
+}
+
+func (l *Logger) WithFields(fields Fields) *Logger {
+	return &Logger{entry: l.entry.WithFields(log.Fields(fields))}
+}
+
+func (l *Logger) WithError(err error) *Logger {
+	return &Logger{entry: l.entry.WithError(err)}
+}
+
+func (l *Logger) Fields() Fields {
+	fields := make(Fields, len(l.entry.Data))
+	for k, v := range l.entry.Data {
+		fields[k] = v
+	}
+	return fields
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.entry.Debugf(format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.entry.Infof(format, args...)
+}
+
+func (l *Logger) Printf(format string, args ...interface{}) {
+	l.entry.Printf(format, args...)
+}
+
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	l.entry.Warningf(format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.entry.Errorf(format, args...)
+}
+
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.entry.Fatalf(format, args...)
+}
+
+func (l *Logger) Panicf(format string, args ...interface{}) {
+	l.entry.Panicf(format, args...)
+}
+
+func (l *Logger) Debug(args ...interface{}) {
+	l.entry.Debug(args...)
+}
+
+func (l *Logger) Info(args ...interface{}) {
+	l.entry.Info(args...)
+}
+
+func (l *Logger) Print(args ...interface{}) {
+	l.entry.Print(args...)
+}
+
+func (l *Logger) Warning(args ...interface{}) {
+	l.entry.Warning(args...)
+}
+
+func (l *Logger) Error(args ...interface{}) {
+	l.entry.Error(args...)
+}
+
+func (l *Logger) Fatal(args ...interface{}) {
+	l.entry.Fatal(args...)
+}
+
+func (l *Logger) Panic(args ...interface{}) {
+	l.entry.Panic(args...)
+}
@@ -9,11 +9,16 @@ type HealthChecker interface {
 	HealthCheck() error
 }
 
+type HealthDetailer interface {
+	HealthDetail() map[string]interface{}
+}
+
 type HealthChecks map[string]HealthChecker
 
 type healthStatus struct {
 	Healthy bool `json:"healthy"`
 	HealthChecksResults map[string]string `json:"healthchecks"`
+	Details map[string]map[string]interface{} `json:"details,omitempty"`
 }
 
 
@@ -29,12 +34,23 @@ func healthinessHandler(healthChecks HealthChecks) func(http.ResponseWriter, *ht
 			} else {
 				hs.HealthChecksResults[name] = "ok"
 			}
+			if detailer, ok := healthCheck.(HealthDetailer); ok {
+				if detail := detailer.HealthDetail(); detail != nil {
+					if hs.Details == nil {
+						hs.Details = make(map[string]map[string]interface{})
+					}
+					hs.Details[name] = detail
+				}
+			}
 		}
 		bytes, err := json.MarshalIndent(hs, "", "\t")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if !hs.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
 		w.Write(bytes)
 	}
 }
@@ -19,6 +19,14 @@ func UpdateTimerSince(name string, ts time.Time, unit time.Duration) {
 	metrics.GetOrRegisterTimer(name, metricsRegistry).Update(time.Since(ts) / unit)
 }
 
+func IncCounter(name string, n int64) {
+	metrics.GetOrRegisterCounter(name, metricsRegistry).Inc(n)
+}
+
+func UpdateGauge(name string, value int64) {
+	metrics.GetOrRegisterGauge(name, metricsRegistry).Update(value)
+}
+
 func WriteJsonMetrics(w io.Writer) {
 	metrics.WriteJSONOnce(metricsRegistry, w)
 }
@@ -0,0 +1,49 @@
+package outbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	migrationVersion = "20181001000000"
+	migrationName    = "create_outbox_events"
+
+	migrationUp = `create_table("outbox_events") {
+	t.Column("id", "string", {"primary": true, "size": 36})
+	t.Column("exchange", "string", {})
+	t.Column("routing_key", "string", {})
+	t.Column("message_id", "string", {})
+	t.Column("correlation_id", "string", {"null": true})
+	t.Column("content_type", "string", {"null": true})
+	t.Column("headers", "text", {"null": true})
+	t.Column("body", "blob", {})
+	t.Column("attempts", "integer", {"default": 0})
+	t.Column("last_error", "text", {"null": true})
+	t.Column("sent_at", "timestamp", {"null": true})
+	t.Column("failed_at", "timestamp", {"null": true})
+}
+add_index("outbox_events", ["sent_at", "created_at"], {})
+`
+	migrationDown = `drop_table("outbox_events")
+`
+)
+
+func WriteMigrations(migrationsPath string) error {
+	files := map[string]string{
+		fmt.Sprintf("%s_%s.up.fizz", migrationVersion, migrationName):   migrationUp,
+		fmt.Sprintf("%s_%s.down.fizz", migrationVersion, migrationName): migrationDown,
+	}
+	for name, content := range files {
+		filename := filepath.Join(migrationsPath, name)
+		if _, err := os.Stat(filename); err == nil {
+			continue
+		}
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed to write outbox migration %s, %s", filename, err)
+		}
+	}
+	return nil
+}
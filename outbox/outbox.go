@@ -0,0 +1,88 @@
+package outbox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gobuffalo/pop"
+
+	"github.com/ivanmtzp/go-microservice/broker"
+)
+
+type Event struct {
+	ID            string     `db:"id"`
+	Exchange      string     `db:"exchange"`
+	RoutingKey    string     `db:"routing_key"`
+	MessageId     string     `db:"message_id"`
+	CorrelationId string     `db:"correlation_id"`
+	ContentType   string     `db:"content_type"`
+	Headers       string     `db:"headers"`
+	Body          []byte     `db:"body"`
+	Attempts      int        `db:"attempts"`
+	LastError     *string    `db:"last_error"`
+	SentAt        *time.Time `db:"sent_at"`
+	FailedAt      *time.Time `db:"failed_at"`
+	CreatedAt     time.Time  `db:"created_at"`
+	UpdatedAt     time.Time  `db:"updated_at"`
+}
+
+func (Event) TableName() string {
+	return "outbox_events"
+}
+
+func (e *Event) Message() (*broker.Message, error) {
+	m := &broker.Message{
+		MessageId:     e.MessageId,
+		CorrelationId: e.CorrelationId,
+		ContentType:   e.ContentType,
+		Timestamp:     e.CreatedAt,
+		Body:          e.Body,
+	}
+	if e.Headers != "" {
+		if err := json.Unmarshal([]byte(e.Headers), &m.Headers); err != nil {
+			return nil, fmt.Errorf("invalid headers for outbox event %s, %s", e.ID, err)
+		}
+	}
+	return m, nil
+}
+
+func newId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func Insert(tx *pop.Connection, exchange, routingKey string, m *broker.Message) (*Event, error) {
+	id, err := newId()
+	if err != nil {
+		return nil, err
+	}
+	e := &Event{
+		ID:            id,
+		Exchange:      exchange,
+		RoutingKey:    routingKey,
+		MessageId:     m.MessageId,
+		CorrelationId: m.CorrelationId,
+		ContentType:   m.ContentType,
+		Body:          m.Body,
+	}
+	if e.MessageId == "" {
+		e.MessageId = id
+	}
+	if len(m.Headers) > 0 {
+		headers, err := json.Marshal(m.Headers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode outbox event headers, %s", err)
+		}
+		e.Headers = string(headers)
+	}
+	if err := tx.Create(e); err != nil {
+		return nil, fmt.Errorf("failed to insert outbox event, %s", err)
+	}
+	return e, nil
+}
@@ -0,0 +1,147 @@
+package outbox
+
+import (
+	"time"
+
+	"github.com/gobuffalo/pop"
+
+	"github.com/ivanmtzp/go-microservice/broker"
+	"github.com/ivanmtzp/go-microservice/database"
+	"github.com/ivanmtzp/go-microservice/log"
+	"github.com/ivanmtzp/go-microservice/monitoring"
+)
+
+type Publisher interface {
+	Publish(exchange, key string, m *broker.Message) error
+}
+
+type Relay struct {
+	database    *database.Database
+	publisher   Publisher
+	interval    time.Duration
+	batchSize   int
+	maxAttempts int
+	done        chan struct{}
+}
+
+type backlog struct {
+	Count  int64      `db:"count"`
+	Oldest *time.Time `db:"oldest"`
+}
+
+// NewRelay publishes the pending events in order. An event failing maxAttempts times is parked,
+// marked as failed so it no longer blocks the events behind it.
+func NewRelay(db *database.Database, publisher Publisher, interval time.Duration, batchSize, maxAttempts int) *Relay {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = 10
+	}
+	return &Relay{database: db, publisher: publisher, interval: interval, batchSize: batchSize, maxAttempts: maxAttempts, done: make(chan struct{})}
+}
+
+func (r *Relay) Interval() time.Duration {
+	return r.interval
+}
+
+func (r *Relay) Run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			for {
+				sent, err := r.relay()
+				if err != nil {
+					log.Errorf("outbox relay failed: %s", err)
+					break
+				}
+				if sent < r.batchSize {
+					break
+				}
+			}
+			if err := r.updateMetrics(); err != nil {
+				log.Warningf("outbox relay failed to read backlog: %s", err)
+			}
+		}
+	}
+}
+
+func (r *Relay) Stop() {
+	close(r.done)
+}
+
+func (r *Relay) selectPendingQuery() string {
+	query := "SELECT * FROM outbox_events WHERE sent_at IS NULL AND failed_at IS NULL ORDER BY created_at LIMIT ?"
+	switch r.database.Dialect() {
+	case "postgres", "mysql":
+		query += " FOR UPDATE SKIP LOCKED"
+	}
+	return query
+}
+
+func (r *Relay) relay() (int, error) {
+	sent := 0
+	err := r.database.Connection().Transaction(func(tx *pop.Connection) error {
+		var events []Event
+		if err := tx.RawQuery(r.selectPendingQuery(), r.batchSize).All(&events); err != nil {
+			return err
+		}
+		for _, e := range events {
+			m, err := e.Message()
+			if err == nil {
+				err = r.publisher.Publish(e.Exchange, e.RoutingKey, m)
+			}
+			if err != nil {
+				return r.fail(tx, e, err)
+			}
+			if err := tx.RawQuery("UPDATE outbox_events SET sent_at = ?, attempts = attempts + 1 WHERE id = ?", time.Now(), e.ID).Exec(); err != nil {
+				return err
+			}
+			sent++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	monitoring.IncCounter("outbox.sent", int64(sent))
+	return sent, nil
+}
+
+func (r *Relay) fail(tx *pop.Connection, e Event, err error) error {
+	monitoring.IncCounter("outbox.failed", 1)
+	if e.Attempts+1 < r.maxAttempts {
+		log.Warningf("outbox event %s publish failed: %s", e.ID, err)
+		return tx.RawQuery("UPDATE outbox_events SET attempts = attempts + 1, last_error = ? WHERE id = ?", err.Error(), e.ID).Exec()
+	}
+	monitoring.IncCounter("outbox.parked", 1)
+	log.Errorf("outbox event %s parked after %d failed attempts: %s", e.ID, e.Attempts+1, err)
+	return tx.RawQuery("UPDATE outbox_events SET attempts = attempts + 1, last_error = ?, failed_at = ? WHERE id = ?", err.Error(), time.Now(), e.ID).Exec()
+}
+
+func (r *Relay) updateMetrics() error {
+	var b backlog
+	err := r.database.Connection().RawQuery("SELECT COUNT(*) AS count, MIN(created_at) AS oldest FROM outbox_events WHERE sent_at IS NULL AND failed_at IS NULL").First(&b)
+	if err != nil {
+		return err
+	}
+	monitoring.UpdateGauge("outbox.backlog", b.Count)
+	var lag time.Duration
+	if b.Oldest != nil {
+		lag = time.Since(*b.Oldest)
+	}
+	monitoring.UpdateGauge("outbox.lag_ms", int64(lag/time.Millisecond))
+	var parked backlog
+	if err := r.database.Connection().RawQuery("SELECT COUNT(*) AS count FROM outbox_events WHERE failed_at IS NOT NULL").First(&parked); err != nil {
+		return err
+	}
+	monitoring.UpdateGauge("outbox.parked_backlog", parked.Count)
+	return nil
+}
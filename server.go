@@ -1,9 +1,12 @@
 package microservice
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"github.com/ivanmtzp/go-microservice/broker"
 	"github.com/ivanmtzp/go-microservice/grpc"
 	"github.com/ivanmtzp/go-microservice/log"
@@ -11,6 +14,7 @@ import (
 	"github.com/ivanmtzp/go-microservice/database"
 	"github.com/ivanmtzp/go-microservice/settings"
 	"github.com/ivanmtzp/go-microservice/monitoring"
+	"github.com/ivanmtzp/go-microservice/outbox"
 )
 
 type GrpcClientsMap map[string]*grpc.Client
@@ -24,7 +28,9 @@ type MicroService struct {
 	grpcClients GrpcClientsMap
 	httpGatewayServer *grpc.HttpGatewayServer
 	database *database.Database
-	rabbitMqBroker *broker.RabbitMqBroker
+	broker broker.Broker
+	kafkaBroker *broker.KafkaBroker
+	outboxRelay *outbox.Relay
 }
 
 
@@ -39,24 +45,85 @@ func NewWithSettingsFile(name, envPrefix, filename string) (*MicroService, error
 	}
 
 	configSettings := settings.NewConfigSettings(conf)
-	logLevel := configSettings.Log().Level
-	if logLevel != "" {
-		if err := log.SetLevel(logLevel); err != nil {
-			return nil, fmt.Errorf("configuration error, invalid log level: %s, ", err)
-		}
+	if err := applyLogSettings(configSettings.Log()); err != nil {
+		return nil, err
 	}
 	log.Infof("log level set to %s", log.Level())
+	configSettings.OnChange("log.level", func(old, new interface{}) {
+		level := fmt.Sprint(new)
+		if err := log.SetLevel(level); err != nil {
+			log.Warningf("invalid log level %s, keeping %s: %s", level, log.Level(), err)
+			return
+		}
+		log.Infof("log level changed to %s", log.Level())
+	})
+	configSettings.OnChange("log.format", func(old, new interface{}) {
+		if err := log.SetFormat(fmt.Sprint(new)); err != nil {
+			log.Warningf("keeping log format %s: %s", log.Format(), err)
+		}
+	})
 	log.Debug("environment variables: ")
 	for _, e := range os.Environ() {
 		if strings.HasPrefix(e, envPrefix) {
-			log.Debug(e)
+			kv := strings.SplitN(e, "=", 2)
+			if len(kv) == 2 {
+				kv[1] = config.RedactURL(kv[1])
+				if config.IsSecretKey(kv[0]) {
+					kv[1] = config.RedactedValue
+				}
+			}
+			log.Debug(strings.Join(kv, "="))
 		}
 	}
 	return New(name, configSettings), nil
 }
 
+func NewWithValidatedSettingsFile(name, envPrefix, filename string) (*MicroService, error) {
+	ms, err := NewWithSettingsFile(name, envPrefix, filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := ms.settings.Validate(); err != nil {
+		return nil, fmt.Errorf("configuration file %s, %s", filename, err)
+	}
+	return ms, nil
+}
+
+func applyLogSettings(l *settings.Log) error {
+	if l.Level != "" {
+		if err := log.SetLevel(l.Level); err != nil {
+			return fmt.Errorf("configuration error, invalid log level: %s", err)
+		}
+	}
+	if err := log.SetFormat(l.Format); err != nil {
+		return fmt.Errorf("configuration error, %s", err)
+	}
+	return nil
+}
+
+func (ms *MicroService) Settings() settings.Reader {
+	return ms.settings
+}
+
+type sourceAdder interface {
+	AddSource(s config.Source) error
+}
+
+func (ms *MicroService) WithConfigSource(s config.Source) error {
+	adder, ok := ms.settings.(sourceAdder)
+	if !ok {
+		return fmt.Errorf("settings don't support configuration sources")
+	}
+	if err := adder.AddSource(s); err != nil {
+		return err
+	}
+	return applyLogSettings(ms.settings.Log())
+}
 
 func (ms *MicroService) WithGrpcAndGatewayServer(sr grpc.ServerServiceRegistrationFunc, gsr grpc.GatewayServerServiceRegistrationFunc, gatewayhealthCheckEndpoint string) (*grpc.Server, *grpc.HttpGatewayServer, error) {
+	if err := ms.settings.Validate(settings.SectionGrpcServer); err != nil {
+		return nil, nil, err
+	}
 	grpcSettings := ms.settings.GrpcServer()
 	grpcServer := grpc.NewServer(grpcSettings.Address, sr)
 	gatewayServer, err := grpc.NewHttpGatewayServer(grpcSettings.GatewayAddress, grpcSettings.Address, gsr, gatewayhealthCheckEndpoint)
@@ -70,6 +137,9 @@ func (ms *MicroService) WithGrpcAndGatewayServer(sr grpc.ServerServiceRegistrati
 }
 
 func (ms *MicroService) WithGrpcClient(name string, serviceCreator grpc.CreateClientServiceFunc) (*grpc.Client, error) {
+	if err := ms.settings.Validate(settings.SectionGrpcClients); err != nil {
+		return nil, err
+	}
 	settings := ms.settings.GrpcClient()
 	address, ok := settings.Endpoints[name]
 	if !ok {
@@ -85,6 +155,9 @@ func (ms *MicroService) WithGrpcClient(name string, serviceCreator grpc.CreateCl
 
 
 func (ms *MicroService) WithGrpcClients(clients map[string]grpc.CreateClientServiceFunc) (GrpcClientsMap, error) {
+	if err := ms.settings.Validate(settings.SectionGrpcClients); err != nil {
+		return nil, err
+	}
 	endpoints := ms.settings.GrpcClient().Endpoints
 	for name, sc := range clients {
 		address, ok := endpoints[name]
@@ -112,36 +185,130 @@ func (m GrpcClientsMap) Close(){
 	}
 }
 
-func (ms *MicroService) RecreateDatabase(migrationsPath string) error {
-	dbs := ms.settings.Database()
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Warningf("received signal %s during startup", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
 
-	s, err := database.NewSchema(dbs)
+// schema shares the connection of the service database when there is one, an in-memory
+// database is only visible through its own connections
+func (ms *MicroService) schema(dryRun bool) (*database.Schema, error) {
+	if ms.database != nil {
+		s := ms.database.Schema()
+		s.SetDryRun(dryRun)
+		return s, nil
+	}
+	if err := ms.settings.Validate(settings.SectionDatabase); err != nil {
+		return nil, err
+	}
+	ctx, cancel := interruptContext()
+	defer cancel()
+	s, err := database.NewSchemaContext(ctx, ms.settings.Database())
+	if err != nil {
+		return nil, err
+	}
+	s.SetDryRun(dryRun)
+	return s, nil
+}
+
+func (ms *MicroService) RecreateDatabase(migrationsPath string) error {
+	s, err := ms.schema(false)
 	if err != nil {
 		return err
 	}
+	defer s.Close()
 	return s.RecreateDatabase(migrationsPath)
 }
 
+func (ms *MicroService) MigrateUp(migrationsPath string, dryRun bool) ([]database.Migration, error) {
+	s, err := ms.schema(dryRun)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return s.MigrateUp(migrationsPath)
+}
+
+func (ms *MicroService) MigrateDown(migrationsPath string, n int, dryRun bool) ([]database.Migration, error) {
+	s, err := ms.schema(dryRun)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return s.MigrateDown(migrationsPath, n)
+}
+
+func (ms *MicroService) MigrateTo(migrationsPath, version string, dryRun bool) ([]database.Migration, error) {
+	s, err := ms.schema(dryRun)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return s.MigrateTo(migrationsPath, version)
+}
+
+func (ms *MicroService) MigrateStatus(migrationsPath string) ([]database.Migration, error) {
+	s, err := ms.schema(false)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return s.MigrateStatus(migrationsPath)
+}
+
 func (ms *MicroService) WithDatabase(healthCheckQuery string) (*database.Database, error) {
+	ctx, cancel := interruptContext()
+	defer cancel()
+	return ms.WithDatabaseContext(ctx, healthCheckQuery)
+}
+
+func (ms *MicroService) WithDatabaseContext(ctx context.Context, healthCheckQuery string) (*database.Database, error) {
+	if err := ms.settings.Validate(settings.SectionDatabase); err != nil {
+		return nil, err
+	}
 	dbs := ms.settings.Database()
 
-	db, err := database.NewDatabase(dbs, healthCheckQuery)
+	db, err := database.NewDatabaseContext(ctx, dbs, healthCheckQuery)
 	if err != nil {
 		return nil, err
 	}
+	// migrations finish before Run starts the servers, so the service isn't reported healthy
+	// or serving with a pending schema
+	if dbs.MigrateOnStart {
+		log.Info("applying database migrations on start")
+		if err := db.MigrateWithLock(); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to apply database migrations, %s", err)
+		}
+		log.Info("database migrations applied")
+	}
 	ms.database = db
 	ms.statusServer.RegisterHealthCheck("database", ms.database)
 	return ms.database, nil
 }
 
 func (ms *MicroService) WithMonitoring() error {
+	if err := ms.settings.Validate(settings.SectionMonitoring); err != nil {
+		return err
+	}
 	monSettings := ms.settings.Monitoring()
 	ms.statusServer.Enable(monSettings.Address)
 	mps := monSettings.InfluxDbMetricsPusher
 	metricsPusher, err := monitoring.NewInfluxDbPusher(
 		mps.InfluxDbProperties.Address,
 		mps.InfluxDbProperties.User,
-		mps.InfluxDbProperties.Password,
+		mps.InfluxDbProperties.Password.Value(),
 		mps.InfluxDbProperties.Database,
 		make(map[string]string),
 		mps.Interval)
@@ -153,35 +320,254 @@ func (ms *MicroService) WithMonitoring() error {
 }
 
 func (ms *MicroService) WithRabbitMqBroker(handlers map[string]broker.ConsumerHandlerFunc) (*broker.RabbitMqBroker, error) {
+	if err := ms.settings.Validate(settings.SectionRabbitMq); err != nil {
+		return nil, err
+	}
 	settings := ms.settings.RabbitMqBroker()
-	rabbitmq, err := broker.NewRabbitMqBroker(settings.Address, settings.PrefetchCount, settings.PrefetchSize)
+	for k, v := range settings.Queues {
+		if err := v.Validate(); err != nil {
+			return nil, fmt.Errorf("rabbitmq queue %s settings error, %s", k, err)
+		}
+	}
+	rabbitmq, err := broker.NewRabbitMqBroker(settings.Address.Value())
 	if err != nil {
 		return nil, err
 	}
 	for k, v := range settings.Queues {
 		_, err := rabbitmq.WithQueue(k, v)
 		if err != nil {
+			rabbitmq.Close()
 			return nil, err
 		}
 	}
 	for k, v := range settings.Consumers {
 		handler, ok := handlers[k]
 		if !ok {
+			rabbitmq.Close()
 			return nil, fmt.Errorf("rabbitmq consumer id not found in settings, %s", k)
 		}
+		if v.Deduplication != nil {
+			store, err := ms.deduplicationStore(k, v.Deduplication)
+			if err != nil {
+				rabbitmq.Close()
+				return nil, err
+			}
+			handler = broker.DeduplicateConsumer(k, v, store, handler)
+		}
 		_, err := rabbitmq.WithConsumerChannel(k, handler, v)
 		if err != nil {
+			rabbitmq.Close()
 			return nil, err
 		}
 	}
-	ms.rabbitMqBroker = rabbitmq
+	ms.broker = rabbitmq
 	return rabbitmq, nil
 }
 
+func (ms *MicroService) deduplicationStore(id string, p *broker.DeduplicationProperties) (broker.DeduplicationStore, error) {
+	switch p.Store {
+	case "", broker.DeduplicationStoreMemory:
+		return broker.NewMemoryDeduplicationStore(p.Size, p.Ttl), nil
+	case broker.DeduplicationStoreDatabase:
+		if ms.database == nil {
+			return nil, fmt.Errorf("consumer %s deduplication store requires a database", id)
+		}
+		return database.NewDeduplicationStore(ms.database, p.Ttl), nil
+	default:
+		return nil, fmt.Errorf("consumer %s unknown deduplication store %s", id, p.Store)
+	}
+}
+
+func (ms *MicroService) deduplicated(id string, handler broker.HandlerFunc, p *broker.DeduplicationProperties) (broker.HandlerFunc, error) {
+	if p == nil {
+		return handler, nil
+	}
+	store, err := ms.deduplicationStore(id, p)
+	if err != nil {
+		return nil, err
+	}
+	return broker.Deduplicate(store, p.Header, handler), nil
+}
+
+// WithBroker declares the queues and consumers of the settings section of b, broker.kafka for a
+// KafkaBroker and broker.rabbitmq otherwise, since the in-memory broker emulates RabbitMQ
+func (ms *MicroService) WithBroker(b broker.Broker, handlers map[string]broker.HandlerFunc) error {
+	var err error
+	switch v := b.(type) {
+	case *broker.RabbitMqBroker:
+		err = ms.withRabbitMqConsumers(v, handlers)
+	case *broker.KafkaBroker:
+		if err = ms.settings.Validate(settings.SectionKafka); err == nil {
+			err = ms.withKafkaConsumers(v, handlers)
+		}
+	default:
+		err = ms.withBrokerConsumers(b, handlers)
+	}
+	if err != nil {
+		return err
+	}
+	ms.broker = b
+	return nil
+}
+
+func (ms *MicroService) withRabbitMqConsumers(rabbitmq *broker.RabbitMqBroker, handlers map[string]broker.HandlerFunc) error {
+	if err := ms.settings.Validate(settings.SectionRabbitMq); err != nil {
+		return err
+	}
+	settings := ms.settings.RabbitMqBroker()
+	for k, v := range settings.Queues {
+		if _, err := rabbitmq.WithQueue(k, v); err != nil {
+			return err
+		}
+	}
+	for k, v := range settings.Consumers {
+		handler, ok := handlers[k]
+		if !ok {
+			return fmt.Errorf("rabbitmq consumer id not found in settings, %s", k)
+		}
+		handler, err := ms.deduplicated(k, handler, v.Deduplication)
+		if err != nil {
+			return err
+		}
+		if err := rabbitmq.WithConsumer(k, handler, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *MicroService) withKafkaConsumers(kafka *broker.KafkaBroker, handlers map[string]broker.HandlerFunc) error {
+	for k, v := range ms.settings.KafkaBroker().Consumers {
+		handler, ok := handlers[k]
+		if !ok {
+			return fmt.Errorf("kafka consumer id not found in settings, %s", k)
+		}
+		handler, err := ms.deduplicated(k, handler, v.Deduplication)
+		if err != nil {
+			return err
+		}
+		if err := kafka.WithConsumer(k, handler, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withBrokerConsumers declares the broker.rabbitmq settings through the broker neutral
+// properties, rejecting the settings they can't express
+func (ms *MicroService) withBrokerConsumers(b broker.Broker, handlers map[string]broker.HandlerFunc) error {
+	settings := ms.settings.RabbitMqBroker()
+	for k, v := range settings.Queues {
+		if _, err := v.Arguments(); err != nil {
+			return fmt.Errorf("rabbitmq queue %s settings error, %s", k, err)
+		}
+		qp, err := v.QueueProperties()
+		if err != nil {
+			return fmt.Errorf("rabbitmq queue %s settings error, %s", k, err)
+		}
+		if _, err := b.DeclareQueue(k, qp); err != nil {
+			return err
+		}
+	}
+	for k, v := range settings.Consumers {
+		handler, ok := handlers[k]
+		if !ok {
+			return fmt.Errorf("broker consumer id not found in settings, %s", k)
+		}
+		handler, err := ms.deduplicated(k, handler, v.Deduplication)
+		if err != nil {
+			return err
+		}
+		cp, err := v.ConsumerProperties()
+		if err != nil {
+			return fmt.Errorf("rabbitmq consumer %s settings error, %s", k, err)
+		}
+		if err := b.Consume(k, handler, cp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *MicroService) WithKafkaBroker(handlers map[string]broker.HandlerFunc) (*broker.KafkaBroker, error) {
+	if err := ms.settings.Validate(settings.SectionKafka); err != nil {
+		return nil, err
+	}
+	settings := ms.settings.KafkaBroker()
+	kafka, err := broker.NewKafkaBroker(settings.Brokers, settings.ClientId, settings.Version)
+	if err != nil {
+		return nil, err
+	}
+	if err := ms.withKafkaConsumers(kafka, handlers); err != nil {
+		kafka.Close()
+		return nil, err
+	}
+	ms.kafkaBroker = kafka
+	ms.statusServer.RegisterHealthCheck("kafka", ms.kafkaBroker)
+	return kafka, nil
+}
+
+func (ms *MicroService) WithOutboxRelay() (*outbox.Relay, error) {
+	if ms.database == nil {
+		return nil, fmt.Errorf("outbox relay requires a database")
+	}
+	if ms.broker == nil {
+		return nil, fmt.Errorf("outbox relay requires a broker")
+	}
+	if err := ms.settings.Validate(settings.SectionOutbox); err != nil {
+		return nil, err
+	}
+	settings := ms.settings.Outbox()
+	var publisher outbox.Publisher = ms.broker
+	if rabbitmq, ok := ms.broker.(*broker.RabbitMqBroker); ok {
+		confirmPublisher, err := rabbitmq.NewConfirmPublisher(settings.PublishTimeout)
+		if err != nil {
+			return nil, err
+		}
+		publisher = confirmPublisher
+	}
+	ms.outboxRelay = outbox.NewRelay(ms.database, publisher, settings.Interval, settings.BatchSize, settings.MaxAttempts)
+	return ms.outboxRelay, nil
+}
+
+func (ms *MicroService) Close() {
+	if ms.outboxRelay != nil {
+		ms.outboxRelay.Stop()
+	}
+	if ms.grpcServer != nil {
+		ms.grpcServer.Stop()
+	}
+	if ms.broker != nil {
+		ms.broker.Close()
+	}
+	if ms.kafkaBroker != nil {
+		ms.kafkaBroker.Close()
+	}
+	ms.grpcClients.Close()
+	if ms.database != nil {
+		ms.database.Close()
+	}
+	if w, ok := ms.settings.(settingsWatcher); ok {
+		w.Close()
+	}
+}
+
+type settingsWatcher interface {
+	Watch() error
+	Close() error
+}
+
 func (ms *MicroService) Run() {
+	if w, ok := ms.settings.(settingsWatcher); ok {
+		if err := w.Watch(); err != nil {
+			log.Warningf("configuration hot reload disabled: %s", err)
+		}
+	}
 
 	if ms.database != nil {
 		log.Infof("starting database connection on %s", ms.database.Address())
+		go ms.database.RunPoolMetrics()
+		go ms.database.RunReplicaHealthChecks()
 	}
 
 	if ms.grpcServer != nil {
@@ -214,14 +600,32 @@ func (ms *MicroService) Run() {
 		log.Warning("monitoring server is disabled")
 	}
 
-	if ms.rabbitMqBroker != nil {
+	if ms.broker != nil {
+		go func() {
+			log.Infof("starting broker on %s ", ms.broker.Address())
+			ms.broker.Run()
+		}()
+	}
+
+	if ms.outboxRelay != nil {
+		go func() {
+			log.Infof("starting outbox relay every %s", ms.outboxRelay.Interval())
+			ms.outboxRelay.Run()
+		}()
+	}
+
+	if ms.kafkaBroker != nil {
 		go func() {
-			log.Infof("starting RabbitMq on %s ", ms.settings.RabbitMqBroker().Address)
-			ms.rabbitMqBroker.Run()
+			log.Infof("starting Kafka on %s", ms.kafkaBroker.Address())
+			ms.kafkaBroker.Run()
 		}()
 	}
 
-	select {}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Infof("received signal %s, shutting down", sig)
+	ms.Close()
 
 }
 
@@ -2,8 +2,10 @@ package settings
 
 import (
 	"fmt"
+	"net/url"
 
 	"github.com/ivanmtzp/go-microservice/config"
+	"github.com/ivanmtzp/go-microservice/log"
 	"github.com/ivanmtzp/go-microservice/database"
 	"github.com/ivanmtzp/go-microservice/broker"
 	"time"
@@ -16,11 +18,17 @@ type Reader interface {
 	GrpcClient() *GrpcClient
 	Monitoring() *Monitoring
 	RabbitMqBroker() *RabbitMqBroker
+	KafkaBroker() *KafkaBroker
+	Outbox() *Outbox
+	OnChange(path string, fn config.ChangeFunc)
+	Validate(sections ...string) error
+	Decode(path string, v interface{}) error
 }
 
 
 type Log struct {
 	Level string
+	Format string
 }
 
 type GrpcServer struct {
@@ -36,7 +44,7 @@ type InfluxDbProperties struct {
 	Address string
 	Database string
 	User string
-	Password string
+	Password config.Secret
 }
 
 type InfluxDbMetricsPusher struct {
@@ -50,117 +58,214 @@ type Monitoring struct {
 }
 
 type RabbitMqBroker struct {
-	Address string
-	PrefetchCount int
-	PrefetchSize int
+	Address config.Secret `config:"-"`
 	Queues map[string]*broker.RabbitMqQueueProperties
 	Consumers map[string]*broker.RabbitMqConsumerProperties
 }
 
+type KafkaBroker struct {
+	Brokers []string
+	ClientId string
+	Version string
+	Consumers map[string]*broker.KafkaConsumerProperties
+}
+
+type Outbox struct {
+	Interval time.Duration
+	BatchSize int
+	PublishTimeout time.Duration `default:"5s"`
+	MaxAttempts int `default:"10"`
+}
+
 type ConfigSettings struct {
 	config *config.Config
 }
 
+// built-in sections are read once when the components start, so they can't be reloaded
+var staticKeys = []string{"host", "grpc", "monitoring", "database", "broker", "outbox"}
+
 func NewConfigSettings(c *config.Config) *ConfigSettings {
+	c.Static(staticKeys...)
 	return &ConfigSettings{config: c}
 }
 
-func (c *ConfigSettings) Log() *Log{
-	return &Log{
-		Level: c.config.GetString("log", "level"),
+func (c *ConfigSettings) OnChange(path string, fn config.ChangeFunc) {
+	c.config.OnChange(path, fn)
+}
+
+func (c *ConfigSettings) Watch() error {
+	return c.config.Watch()
+}
+
+func (c *ConfigSettings) AddSource(s config.Source) error {
+	return c.config.AddSource(s)
+}
+
+func (c *ConfigSettings) Close() error {
+	return c.config.Close()
+}
+
+func (c *ConfigSettings) Decode(path string, v interface{}) error {
+	return c.config.Decode(path, v)
+}
+
+// sections are validated before they are used, decode errors are only logged by the getters
+func (c *ConfigSettings) decode(path string, v interface{}) {
+	if err := c.config.Decode(path, v); err != nil {
+		log.Warningf("settings %s: %s", path, err)
 	}
 }
 
+func (c *ConfigSettings) Log() *Log{
+	l := &Log{}
+	c.decode("log", l)
+	return l
+}
+
 func (c *ConfigSettings) Database() *database.Properties {
-	return &database.Properties{
-		Dialect: c.config.GetString("database", "dialect"),
-		Database: c.config.GetString("database", "name"),
-		Host: c.config.GetString("database", "host"),
-		Port: c.config.GetInt("database", "port"),
-		User: c.config.GetString("database", "user"),
-		Password: c.config.GetString("database", "password"),
-		Pool: c.config.GetInt("database", "pool"),
+	p := &database.Properties{}
+	c.decode("database", p)
+	p.Instrumentation.Enabled = p.Instrumentation.Enabled || p.Instrumentation.SlowQueryThreshold > 0
+	if p.URL != "" {
+		// parse errors are reported when the connection is created
+		p.ApplyURL(p.URL.Value())
+	}
+	replicas := c.config.GetStringMap("database", "replicas")
+	if len(replicas) > 0 {
+		p.Replicas = make(map[string]*database.Properties)
 	}
+	for k, _ := range replicas {
+		// replicas inherit every setting they don't override from the primary
+		replica := *p
+		replica.URL = ""
+		c.decode("database.replicas." + k, &replica)
+		replica.Replicas = nil
+		replica.MigrateOnStart = false
+		if replica.URL != "" {
+			replica.ApplyURL(replica.URL.Value())
+		}
+		p.Replicas[k] = &replica
+	}
+	return p
+}
+
+type grpcServerSection struct {
+	Port int
+	GatewayPort int
 }
 
 func (c *ConfigSettings) GrpcServer() *GrpcServer {
 	host := c.config.GetString("host")
+	s := &grpcServerSection{}
+	c.decode("grpc.server", s)
 	return &GrpcServer{
-		Address: fmt.Sprintf("%s:%d", host, c.config.GetInt("grpc", "server", "port")),
-		GatewayAddress: fmt.Sprintf("%s:%d", host, c.config.GetInt("grpc", "server", "gateway_port")),
+		Address: fmt.Sprintf("%s:%d", host, s.Port),
+		GatewayAddress: fmt.Sprintf("%s:%d", host, s.GatewayPort),
 	}
 }
 
+type endpointSection struct {
+	Host string
+	Port int
+}
+
 func (c* ConfigSettings) GrpcClient() *GrpcClient {
+	s := &struct {
+		Clients map[string]endpointSection
+	}{}
+	c.decode("grpc", s)
 	endpoints := make(map[string]string)
-	for k, _ := range c.config.GetStringMap("grpc", "clients") {
-		endpoints[k] = fmt.Sprintf("%s:%d", c.config.GetString("grpc", "clients", k, "host"),
-			c.config.GetInt("grpc", "clients", k, "port"))
+	for k, v := range s.Clients {
+		endpoints[k] = fmt.Sprintf("%s:%d", v.Host, v.Port)
 	}
 	return &GrpcClient{Endpoints: endpoints}
 }
 
+type influxDbPusherSection struct {
+	Host string
+	Port int
+	Database string
+	User string
+	Password config.Secret
+	Interval int
+}
+
+type monitoringSection struct {
+	Port int
+	Metrics struct {
+		InfluxDbPusher *influxDbPusherSection `config:"influxdb_pusher"`
+	}
+}
+
 func (c *ConfigSettings) Monitoring() *Monitoring {
+	s := &monitoringSection{}
+	c.decode("monitoring", s)
 	var imp *InfluxDbMetricsPusher
-	_, ok := c.config.HasKey("monitoring", "metrics", "influxdb_pusher")
-	if ok {
+	if ip := s.Metrics.InfluxDbPusher; ip != nil {
 		imp = &InfluxDbMetricsPusher{
-			Interval: time.Second * time.Duration(c.config.GetInt("monitoring", "metrics", "influxdb_pusher", "interval")),
+			Interval: time.Second * time.Duration(ip.Interval),
 			InfluxDbProperties: &InfluxDbProperties{
-				Address: fmt.Sprintf("http://%s:%d",  c.config.GetString("monitoring", "metrics", "influxdb_pusher", "host"),
-					c.config.GetInt("monitoring", "metrics", "influxdb_pusher", "port")),
-				Database: c.config.GetString("monitoring", "metrics", "influxdb_pusher", "database"),
-				User:     c.config.GetString("monitoring", "metrics", "influxdb_pusher", "user"),
-				Password: c.config.GetString("monitoring", "metrics", "influxdb_pusher", "password"),
+				Address: fmt.Sprintf("http://%s:%d", ip.Host, ip.Port),
+				Database: ip.Database,
+				User:     ip.User,
+				Password: ip.Password,
 			},
 		}
 	}
 	return &Monitoring{
-		Address: fmt.Sprintf("%s:%d", c.config.GetString("host"), c.config.GetInt("monitoring", "port")),
+		Address: fmt.Sprintf("%s:%d", c.config.GetString("host"), s.Port),
 		InfluxDbMetricsPusher: imp,
 	}
 }
 
+type rabbitMqSection struct {
+	Host string
+	Port int
+	User string
+	Password config.Secret
+	Qos struct {
+		PrefetchCount int
+		PrefetchSize int
+	}
+}
+
 func (c* ConfigSettings) RabbitMqBroker() *RabbitMqBroker {
-	queues := make(map[string]*broker.RabbitMqQueueProperties)
-	queuesConfig := c.config.GetStringMap("broker", "rabbitmq", "queues")
-	for k, _ := range queuesConfig {
-		queues[k] = &broker.RabbitMqQueueProperties {
-			Name: c.config.GetString("broker", "rabbitmq", "queues", k, "name"),
-			Durable: c.config.GetBool("broker", "rabbitmq", "queues", k, "durable"),
-			AutoDelete: c.config.GetBool("broker", "rabbitmq", "queues", k, "auto_delete"),
-			Exclusive: c.config.GetBool("broker", "rabbitmq", "queues", k, "exclusive"),
-			NoWait: c.config.GetBool("broker", "rabbitmq", "queues", k, "no_wait"),
-		}
+	s := &rabbitMqSection{}
+	c.decode("broker.rabbitmq", s)
+	b := &RabbitMqBroker{
+		Address: config.Secret(amqpURL(s).String()),
+		Queues: make(map[string]*broker.RabbitMqQueueProperties),
+		Consumers: make(map[string]*broker.RabbitMqConsumerProperties),
 	}
-	consumers :=  make(map[string]*broker.RabbitMqConsumerProperties)
-	consumersConfig := c.config.GetStringMap("broker", "rabbitmq", "consumers")
-	for k, _ := range consumersConfig {
-		consumers[k] = &broker.RabbitMqConsumerProperties {
-			Name: c.config.GetString("broker", "rabbitmq", "consumers", k, "name"),
-			QueueName: c.config.GetString("broker", "rabbitmq", "consumers", k, "queue_name"),
-			AutoAck: c.config.GetBool("broker", "rabbitmq", "consumers", k, "auto_ack"),
-			Exclusive: c.config.GetBool("broker", "rabbitmq", "consumers", k, "exclusive"),
-			NoLocal: c.config.GetBool("broker", "rabbitmq", "consumers", k, "no_local"),
-			NoWait: c.config.GetBool("broker", "rabbitmq", "consumers", k, "no_wait"),
+	c.decode("broker.rabbitmq", b)
+	for k, v := range b.Consumers {
+		if _, ok := c.config.HasKey("broker", "rabbitmq", "consumers", k, "qos", "prefetch_count"); !ok {
+			v.PrefetchCount = s.Qos.PrefetchCount
+		}
+		if _, ok := c.config.HasKey("broker", "rabbitmq", "consumers", k, "qos", "prefetch_size"); !ok {
+			v.PrefetchSize = s.Qos.PrefetchSize
 		}
 	}
-	return &RabbitMqBroker{
-		Address: fmt.Sprintf("amqp://%s:%s@%s:%d/",
-			c.config.GetString("broker", "rabbitmq", "user"),
-			c.config.GetString("broker", "rabbitmq", "password"),
-			c.config.GetString("broker", "rabbitmq", "host"),
-			c.config.GetInt("broker", "rabbitmq", "port")	),
-		PrefetchCount: c.config.GetInt("broker", "rabbitmq", "qos", "prefetch_count"),
-		PrefetchSize: c.config.GetInt("broker", "rabbitmq", "qos", "prefetch_size"),
-		Queues: queues,
-		Consumers: consumers,
-	}
+	return b
 }
 
+func amqpURL(s *rabbitMqSection) *url.URL {
+	return &url.URL{
+		Scheme: "amqp",
+		User: url.UserPassword(s.User, s.Password.Value()),
+		Host: fmt.Sprintf("%s:%d", s.Host, s.Port),
+		Path: "/",
+	}
+}
 
+func (c *ConfigSettings) KafkaBroker() *KafkaBroker {
+	k := &KafkaBroker{Consumers: make(map[string]*broker.KafkaConsumerProperties)}
+	c.decode("broker.kafka", k)
+	return k
+}
 
-
-
-
-
+func (c *ConfigSettings) Outbox() *Outbox {
+	o := &Outbox{}
+	c.decode("outbox", o)
+	return o
+}
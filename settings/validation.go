@@ -0,0 +1,362 @@
+package settings
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/spf13/cast"
+
+	"github.com/ivanmtzp/go-microservice/broker"
+	"github.com/ivanmtzp/go-microservice/database"
+	"github.com/ivanmtzp/go-microservice/log"
+)
+
+const (
+	SectionLog         = "log"
+	SectionGrpcServer  = "grpc.server"
+	SectionGrpcClients = "grpc.clients"
+	SectionMonitoring  = "monitoring"
+	SectionDatabase    = "database"
+	SectionRabbitMq    = "broker.rabbitmq"
+	SectionKafka       = "broker.kafka"
+	SectionOutbox      = "outbox"
+)
+
+type ValidationError struct {
+	Key     string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s %s", e.Key, e.Message)
+}
+
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("invalid settings: %s", strings.Join(messages, "; "))
+}
+
+type valueKind int
+
+const (
+	stringValue valueKind = iota
+	intValue
+	boolValue
+	durationValue
+	stringSliceValue
+)
+
+func (k valueKind) String() string {
+	switch k {
+	case intValue:
+		return "an integer"
+	case boolValue:
+		return "a boolean"
+	case durationValue:
+		return "a duration"
+	case stringSliceValue:
+		return "a list of strings"
+	default:
+		return "a string"
+	}
+}
+
+type rule struct {
+	key      string
+	kind     valueKind
+	required bool
+	min, max *int
+	enum     []string
+	when     func(c *ConfigSettings, key string) bool
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+var (
+	logLevels   = []string{"panic", "fatal", "error", "warn", "warning", "info", "debug"}
+	dialects    = []string{"postgres", "cockroach", "mysql", database.SQLiteDialect, "sqlite"}
+	portRule    = rule{kind: intValue, min: intPtr(1), max: intPtr(65535)}
+	positiveInt = rule{kind: intValue, min: intPtr(0)}
+)
+
+func withKey(r rule, key string, required bool) rule {
+	r.key = key
+	r.required = required
+	return r
+}
+
+// database connection keys are optional when the connection is given as a url or for sqlite
+func databaseServer(c *ConfigSettings, key string) bool {
+	if c.config.GetString("database", "url") != "" {
+		return false
+	}
+	return !strings.HasPrefix(c.config.GetString("database", "dialect"), "sqlite")
+}
+
+func databaseDialect(c *ConfigSettings, key string) bool {
+	return c.config.GetString("database", "url") == ""
+}
+
+func databaseReplica(c *ConfigSettings, key string) bool {
+	return c.config.GetString(strings.TrimSuffix(key, ".port")+".url") == "" && databaseServer(c, key)
+}
+
+var sectionRules = map[string][]rule{
+	SectionLog: {
+		{key: "log.level", enum: logLevels},
+		{key: "log.format", enum: []string{log.TextFormat, log.JsonFormat}},
+	},
+	SectionGrpcServer: {
+		{key: "host"},
+		withKey(portRule, "grpc.server.port", true),
+		withKey(portRule, "grpc.server.gateway_port", true),
+	},
+	SectionGrpcClients: {
+		{key: "grpc.clients.*.host", required: true},
+		withKey(portRule, "grpc.clients.*.port", true),
+	},
+	SectionMonitoring: {
+		{key: "host"},
+		withKey(portRule, "monitoring.port", true),
+		{key: "monitoring.metrics.influxdb_pusher.host", required: true},
+		withKey(portRule, "monitoring.metrics.influxdb_pusher.port", true),
+		{key: "monitoring.metrics.influxdb_pusher.database", required: true},
+		{key: "monitoring.metrics.influxdb_pusher.interval", kind: intValue, required: true, min: intPtr(1)},
+	},
+	SectionDatabase: {
+		{key: "database.url"},
+		{key: "database.dialect", required: true, enum: dialects, when: databaseDialect},
+		{key: "database.name", required: true, when: databaseServer},
+		{key: "database.host", required: true, when: databaseServer},
+		{key: "database.port", kind: intValue, required: true, min: intPtr(1), max: intPtr(65535), when: databaseServer},
+		withKey(positiveInt, "database.pool", false),
+		withKey(positiveInt, "database.max_idle", false),
+		{key: "database.conn_max_lifetime", kind: durationValue},
+		{key: "database.conn_max_idle_time", kind: durationValue},
+		{key: "database.pool_metrics_interval", kind: durationValue},
+		withKey(positiveInt, "database.connect_retry.max_attempts", false),
+		{key: "database.connect_retry.initial_backoff", kind: durationValue},
+		{key: "database.connect_retry.max_backoff", kind: durationValue},
+		{key: "database.connect_retry.deadline", kind: durationValue},
+		withKey(positiveInt, "database.transaction_retry.max_attempts", false),
+		{key: "database.transaction_retry.initial_backoff", kind: durationValue},
+		{key: "database.transaction_retry.max_backoff", kind: durationValue},
+		{key: "database.migrate_on_start", kind: boolValue},
+		{key: "database.migrate_lock_timeout", kind: durationValue},
+		{key: "database.instrument_queries", kind: boolValue},
+		{key: "database.slow_query_threshold", kind: durationValue},
+		{key: "database.slow_query_log_params", kind: boolValue},
+		{key: "database.replica_fallback", kind: boolValue},
+		{key: "database.replica_health_check_interval", kind: durationValue},
+		{key: "database.replicas.*.port", kind: intValue, min: intPtr(1), max: intPtr(65535), when: databaseReplica},
+	},
+	SectionRabbitMq: {
+		{key: "broker.rabbitmq.host", required: true},
+		withKey(portRule, "broker.rabbitmq.port", true),
+		{key: "broker.rabbitmq.user"},
+		withKey(positiveInt, "broker.rabbitmq.qos.prefetch_count", false),
+		withKey(positiveInt, "broker.rabbitmq.qos.prefetch_size", false),
+		{key: "broker.rabbitmq.queues.*.durable", kind: boolValue},
+		{key: "broker.rabbitmq.queues.*.type", enum: []string{broker.ClassicQueue, broker.QuorumQueue}},
+		{key: "broker.rabbitmq.queues.*.message_ttl", kind: durationValue},
+		{key: "broker.rabbitmq.queues.*.expires", kind: durationValue},
+		withKey(positiveInt, "broker.rabbitmq.queues.*.max_length", false),
+		withKey(positiveInt, "broker.rabbitmq.queues.*.max_length_bytes", false),
+		{key: "broker.rabbitmq.queues.*.overflow", enum: []string{broker.OverflowDropHead, broker.OverflowRejectPublish, broker.OverflowRejectPublishDlx}},
+		{key: "broker.rabbitmq.consumers.*.queue_name", required: true},
+		{key: "broker.rabbitmq.consumers.*.auto_ack", kind: boolValue},
+		withKey(positiveInt, "broker.rabbitmq.consumers.*.qos.prefetch_count", false),
+		withKey(positiveInt, "broker.rabbitmq.consumers.*.qos.prefetch_size", false),
+		{key: "broker.rabbitmq.consumers.*.deduplication.store", enum: []string{broker.DeduplicationStoreMemory, broker.DeduplicationStoreDatabase}},
+		{key: "broker.rabbitmq.consumers.*.deduplication.ttl", kind: durationValue},
+		withKey(positiveInt, "broker.rabbitmq.consumers.*.deduplication.size", false),
+	},
+	SectionKafka: {
+		{key: "broker.kafka.brokers", kind: stringSliceValue, required: true},
+		{key: "broker.kafka.consumers.*.group_id", required: true},
+		{key: "broker.kafka.consumers.*.topics", kind: stringSliceValue, required: true},
+		{key: "broker.kafka.consumers.*.initial_offset", enum: []string{broker.KafkaOffsetOldest, broker.KafkaOffsetNewest}},
+		{key: "broker.kafka.consumers.*.commit", enum: []string{broker.KafkaCommitAuto, broker.KafkaCommitSync}},
+		{key: "broker.kafka.consumers.*.auto_commit_interval", kind: durationValue},
+		{key: "broker.kafka.consumers.*.deduplication.store", enum: []string{broker.DeduplicationStoreMemory, broker.DeduplicationStoreDatabase}},
+		{key: "broker.kafka.consumers.*.deduplication.ttl", kind: durationValue},
+		withKey(positiveInt, "broker.kafka.consumers.*.deduplication.size", false),
+	},
+	SectionOutbox: {
+		{key: "outbox.interval", kind: durationValue},
+		withKey(positiveInt, "outbox.batch_size", false),
+		{key: "outbox.publish_timeout", kind: durationValue},
+		withKey(positiveInt, "outbox.max_attempts", false),
+	},
+}
+
+var listeningPorts = []string{"grpc.server.port", "grpc.server.gateway_port", "monitoring.port"}
+
+// Validate checks the given sections, or every configured section when none is given,
+// and returns all the problems found as ValidationErrors
+func (c *ConfigSettings) Validate(sections ...string) error {
+	if len(sections) == 0 {
+		for section := range sectionRules {
+			if _, ok := c.config.HasKey(strings.Split(section, ".")...); ok || section == SectionLog {
+				sections = append(sections, section)
+			}
+		}
+		sort.Strings(sections)
+	}
+	var errs ValidationErrors
+	checkPorts := false
+	for _, section := range sections {
+		rules, ok := sectionRules[section]
+		if !ok {
+			errs = append(errs, &ValidationError{Key: section, Message: "is not a known settings section"})
+			continue
+		}
+		for _, r := range rules {
+			errs = append(errs, c.validateRule(r)...)
+		}
+		checkPorts = checkPorts || section == SectionGrpcServer || section == SectionMonitoring
+	}
+	if checkPorts {
+		errs = append(errs, c.validatePorts()...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (c *ConfigSettings) expandKey(key string) []string {
+	i := strings.Index(key, ".*")
+	if i < 0 {
+		return []string{key}
+	}
+	prefix, suffix := key[:i], key[i+2:]
+	var names []string
+	for name := range c.config.GetStringMap(strings.Split(prefix, ".")...) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var keys []string
+	for _, name := range names {
+		keys = append(keys, c.expandKey(prefix+"."+name+suffix)...)
+	}
+	return keys
+}
+
+func (c *ConfigSettings) validateRule(r rule) ValidationErrors {
+	var errs ValidationErrors
+	for _, key := range c.expandKey(r.key) {
+		if r.when != nil && !r.when(c, key) {
+			continue
+		}
+		if err := c.validateKey(key, r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func (c *ConfigSettings) validateKey(key string, r rule) *ValidationError {
+	value, ok := c.config.HasKey(strings.Split(key, ".")...)
+	if !ok || value == "" {
+		if r.required {
+			return &ValidationError{Key: key, Message: "is required"}
+		}
+		return nil
+	}
+	invalid := &ValidationError{Key: key, Message: fmt.Sprintf("must be %s, got %v", r.kind, value)}
+	switch r.kind {
+	case intValue:
+		i, err := cast.ToIntE(value)
+		if err != nil {
+			return invalid
+		}
+		if r.min != nil && i < *r.min {
+			return &ValidationError{Key: key, Message: fmt.Sprintf("must be at least %d, got %d", *r.min, i)}
+		}
+		if r.max != nil && i > *r.max {
+			return &ValidationError{Key: key, Message: fmt.Sprintf("must be at most %d, got %d", *r.max, i)}
+		}
+	case boolValue:
+		if _, err := cast.ToBoolE(value); err != nil {
+			return invalid
+		}
+	case durationValue:
+		d, err := cast.ToDurationE(value)
+		if err != nil {
+			return invalid
+		}
+		if d != 0 && !hasUnit(value) {
+			return &ValidationError{Key: key, Message: fmt.Sprintf("must be a duration with a unit such as 60s or 500ms, got %v", value)}
+		}
+	case stringSliceValue:
+		s, err := cast.ToStringSliceE(value)
+		if err != nil {
+			return invalid
+		}
+		if r.required && len(s) == 0 {
+			return &ValidationError{Key: key, Message: "is required"}
+		}
+	default:
+		s, err := cast.ToStringE(value)
+		if err != nil {
+			return invalid
+		}
+		if len(r.enum) > 0 && !contains(r.enum, strings.ToLower(s)) {
+			return &ValidationError{Key: key, Message: fmt.Sprintf("must be one of %s, got %s", strings.Join(r.enum, ", "), s)}
+		}
+	}
+	return nil
+}
+
+// hasUnit rejects bare integers as durations, they would be read as nanoseconds
+func hasUnit(value interface{}) bool {
+	switch v := value.(type) {
+	case time.Duration:
+		return true
+	case string:
+		return strings.IndexFunc(v, unicode.IsLetter) >= 0
+	default:
+		return false
+	}
+}
+
+func (c *ConfigSettings) validatePorts() ValidationErrors {
+	var errs ValidationErrors
+	used := make(map[int]string)
+	for _, key := range listeningPorts {
+		value, ok := c.config.HasKey(strings.Split(key, ".")...)
+		if !ok {
+			continue
+		}
+		port, err := cast.ToIntE(value)
+		if err != nil || port == 0 {
+			continue
+		}
+		if other, ok := used[port]; ok {
+			errs = append(errs, &ValidationError{Key: key, Message: fmt.Sprintf("port %d is already used by %s", port, other)})
+			continue
+		}
+		used[port] = key
+	}
+	return errs
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}